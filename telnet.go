@@ -1,6 +1,9 @@
 package pactelnet
 
 import "bytes"
+import "compress/zlib"
+import "fmt"
+import "time"
 import "github.com/yourbasic/bit"
 
 type Telnet struct {
@@ -12,10 +15,42 @@ type Telnet struct {
 	internalFlags *bit.Set
 	sb_telopt     byte
 	buffer        *bytes.Buffer
-	rfc1143List   []TelnetRFC1143
+	rfc1143       [256]byte
+	inflater      *inflateStream
+	deflater      *zlib.Writer
+	deflateTelOpt byte
+	deflateBuffer bytes.Buffer
+	// compressed data not flushed yet, see beginOutput
+	deflateDirty  bool
+	outputDepth   int
+	ttypeIndex    int
+	timingMarks   []time.Time
+	handlers      map[byte]OptionHandler
+	events        eventCache
 	OnTelnetEvent func(telnetEvent TelnetEventInterface)
+	// Terminal types reported on TERMINAL-TYPE SEND requests, most
+	// preferred first; empty list disables automatic replies
+	TerminalTypes []string
+	// MSSP variables sent as soon as the peer agrees to DO MSSP;
+	// we have to offer the option with TelnetNegotiate(TELNET_WILL, TELOPT_MSSP)
+	MSSP map[string][]string
+	// Limit of subnegotiation data size, TELNET_DEFAULT_SB_SIZE by
+	// default; zero or negative value disables the limit
+	MaxSubnegotiation int
+	// Deliver DATA, SEND, IAC and negotiation events in objects owned
+	// by the state tracker, so steady-state processing does not allocate.
+	// Such an event and its Buffer are valid only during the OnTelnetEvent
+	// call and must be copied if needed later.
+	ReuseEvents bool
+	// Text sent in reply to IAC AYT after the IAC event, e.g. "[yes]";
+	// empty text disables automatic replies
+	AYTResponse string
 }
 
+// Create a telnet state tracker. Inbound COMPRESS2/MCCP3 streams are
+// inflated in a helper goroutine; it is stopped by TelnetClose, or
+// when the state tracker is garbage collected if TelnetClose was not
+// called.
 func NewTelnet(options []TelnetOptionReq, flags []TelnetFlags, userData interface{}) *Telnet {
 	tl := new(Telnet)
 	tl.telOpts = options
@@ -29,25 +64,111 @@ func NewTelnet(options []TelnetOptionReq, flags []TelnetFlags, userData interfac
 	//tl.internalFlags = make([]telnetInternalFlags, 0)
 	tl.internalFlags = new(bit.Set)
 	tl.buffer = bytes.NewBuffer(make([]byte, 0, 512))
-	tl.rfc1143List = make([]TelnetRFC1143, 0)
+	tl.MaxSubnegotiation = TELNET_DEFAULT_SB_SIZE
 
 	return tl
 }
 
 //------------------------------------------------------------------------------------------------//
 
+// Process data received from the peer. Once the peer starts COMPRESS2
+// or MCCP3 compression, the rest of the stream is inflated in a helper
+// goroutine, see TelnetClose.
 func (tl *Telnet) TelnetRecv(buffer []byte) {
+	// inflate the stream if COMPRESS2 or MCCP3 was activated
+	if tl.inflater != nil {
+		tl.inflate(buffer)
+		return
+	}
 	tl.process(buffer)
 }
 
 //------------------------------------------------------------------------------------------------//
 
+// Begin sending compressed data, using the COMPRESS2 option
+func (tl *Telnet) TelnetBeginCompress2() {
+	if tl.internalFlags.Contains(int(TELNET_PFLAG_DEFLATE)) {
+		tl.raiseError(TELNET_EBADVAL, false, "cannot initialize compression twice")
+		return
+	}
+
+	/* send compression marker; we send directly to the event handler
+	 * instead of passing through send() because it would result in
+	 * the compress marker itself being compressed.
+	 */
+	tl.sendEvent([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_COMPRESS2, TELNET_IAC, byte(TELNET_SE)})
+	tl.beginDeflate(TELOPT_COMPRESS2)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Terminate the compressed stream started with TelnetBeginCompress2;
+// data sent afterwards is not compressed
+func (tl *Telnet) TelnetEndCompress2() {
+	tl.endDeflate()
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Begin sending compressed data to the server, using the MCCP3 option.
+// Server must have offered the option (WILL MCCP3) and we must have
+// agreed to it, otherwise nothing is done.
+func (tl *Telnet) TelnetBeginCompress3() {
+	if tl.internalFlags.Contains(int(TELNET_PFLAG_DEFLATE)) {
+		tl.raiseError(TELNET_EBADVAL, false, "cannot initialize compression twice")
+		return
+	}
+	if !tl.flags.Contains(int(TELNET_FLAG_PROXY)) && q_HIM(tl.getRFC1143(TELOPT_MCCP3)) != byte(Q_YES) {
+		tl.raiseError(TELNET_EBADVAL, false, "MCCP3 is not enabled by the server")
+		return
+	}
+
+	// compress marker must not be compressed, see TelnetBeginCompress2
+	tl.sendEvent([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_MCCP3, TELNET_IAC, byte(TELNET_SE)})
+	tl.beginDeflate(TELOPT_MCCP3)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Terminate the compressed stream started with TelnetBeginCompress3
+func (tl *Telnet) TelnetEndCompress3() {
+	tl.endDeflate()
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Release resources held by the telnet state tracker. Compressed
+// stream is abandoned and its inflater goroutine is stopped; call this
+// when the connection is closed, otherwise the goroutine is stopped
+// only when the state tracker is garbage collected.
+func (tl *Telnet) TelnetClose() {
+	if tl.inflater != nil {
+		tl.inflater.close()
+		tl.inflater = nil
+	}
+	if tl.deflater != nil {
+		tl.internalFlags.Delete(int(TELNET_PFLAG_DEFLATE))
+		tl.deflater = nil
+	}
+	tl.timingMarks = nil
+}
+
+//------------------------------------------------------------------------------------------------//
+
 // Send negotiation
 func (tl *Telnet) TelnetNegotiate(cmd TelnetCommands, telopt byte) {
 	// if we're in proxy mode, just send it now
 	if tl.flags.Contains(int(TELNET_FLAG_PROXY)) {
-		data := []byte{TELNET_IAC, byte(cmd), telopt}
-		tl.send(data)
+		tl.sendNegotiate(cmd, telopt)
+		return
+	}
+
+	// TIMING-MARK is not a stateful option: DO requests a mark, other
+	// commands have no meaning outside of a reply
+	if telopt == byte(TELOPT_TM) {
+		if cmd == TELNET_DO {
+			tl.TelnetTimingMark()
+		}
 		return
 	}
 
@@ -72,6 +193,7 @@ func (tl *Telnet) TelnetNegotiate(cmd TelnetCommands, telopt byte) {
 		switch q_US(q) {
 		case byte(Q_YES):
 			tl.setRFC1143(telopt, byte(Q_WANTNO), q_HIM(q))
+			tl.optionChanged(telopt, q)
 			tl.sendNegotiate(TELNET_WONT, telopt)
 		case byte(Q_WANTYES):
 			tl.setRFC1143(telopt, byte(Q_WANTYES_OP), q_HIM(q))
@@ -96,6 +218,7 @@ func (tl *Telnet) TelnetNegotiate(cmd TelnetCommands, telopt byte) {
 		switch q_HIM(q) {
 		case byte(Q_YES):
 			tl.setRFC1143(telopt, q_US(q), byte(Q_WANTNO))
+			tl.optionChanged(telopt, q)
 			tl.sendNegotiate(TELNET_DONT, telopt)
 		case byte(Q_WANTYES):
 			tl.setRFC1143(telopt, q_US(q), byte(Q_WANTYES_OP))
@@ -107,9 +230,45 @@ func (tl *Telnet) TelnetNegotiate(cmd TelnetCommands, telopt byte) {
 
 //------------------------------------------------------------------------------------------------//
 
+// Check if we perform the option
+func (tl *Telnet) LocalEnabled(telopt byte) bool {
+	return q_US(tl.getRFC1143(telopt)) == byte(Q_YES)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Check if the peer performs the option
+func (tl *Telnet) RemoteEnabled(telopt byte) bool {
+	return q_HIM(tl.getRFC1143(telopt)) == byte(Q_YES)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Get RFC1143 state of the option on both sides
+func (tl *Telnet) OptionState(telopt byte) TelnetRFC1143 {
+	return tl.getRFC1143(telopt)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Get states of all options not disabled on both sides
+func (tl *Telnet) OptionStates() []TelnetRFC1143 {
+	var states []TelnetRFC1143
+	for i, state := range tl.rfc1143 {
+		if state != 0 {
+			states = append(states, TelnetRFC1143{telopt: byte(i), state: state})
+		}
+	}
+	return states
+}
+
+//------------------------------------------------------------------------------------------------//
+
 // Send an iac command
 func (tl *Telnet) TelnetIAC(cmd byte) {
-	data := []byte{TELNET_IAC, byte(cmd)}
+	data := tl.commandBuffer(2)
+	data[0] = TELNET_IAC
+	data[1] = cmd
 	tl.send(data)
 }
 
@@ -117,13 +276,16 @@ func (tl *Telnet) TelnetIAC(cmd byte) {
 
 // Send non-command data (escapes IAC bytes)
 func (tl *Telnet) TelnetSend(buffer []byte) {
-	var ln, i int
-	for i, _ = range buffer {
+	tl.beginOutput()
+	defer tl.endOutput()
+
+	var ln int
+	for i := range buffer {
 		// dump prior portion of text, send escaped bytes
 		if buffer[i] == byte(TELNET_IAC) {
 			// dump prior text if any
 			if i != ln {
-				tl.send(buffer[ln:])
+				tl.send(buffer[ln:i])
 			}
 			ln = i + 1
 
@@ -133,7 +295,7 @@ func (tl *Telnet) TelnetSend(buffer []byte) {
 	}
 
 	// send whatever portion of buffer is left
-	if i != ln {
+	if ln != len(buffer) {
 		tl.send(buffer[ln:])
 	}
 }
@@ -141,23 +303,26 @@ func (tl *Telnet) TelnetSend(buffer []byte) {
 //------------------------------------------------------------------------------------------------//
 
 func (tl *Telnet) TelnetSendText(buffer []byte) {
-	var ln, i int
+	tl.beginOutput()
+	defer tl.endOutput()
+
+	var ln int
 
-	for i, _ = range buffer {
+	for i := range buffer {
 		// dump prior portion of text, send escaped bytes
 		if buffer[i] == byte(TELNET_IAC) {
 			// dump prior text if any
 			if i != ln {
-				tl.send(buffer[ln:])
+				tl.send(buffer[ln:i])
 			}
 			ln = i + 1
 
 			// send escape
 			tl.TelnetIAC(byte(TELNET_IAC))
-		} else if tl.internalFlags.Contains(int(TELNET_FLAG_TRANSMIT_BINARY)) && (buffer[i] == '\r' || buffer[i] == '\n') {
+		} else if !tl.internalFlags.Contains(int(TELNET_FLAG_TRANSMIT_BINARY)) && (buffer[i] == '\r' || buffer[i] == '\n') {
 			// dump prior portion of text
 			if i != ln {
-				tl.send(buffer[ln:])
+				tl.send(buffer[ln:i])
 			}
 			ln = i + 1
 
@@ -172,11 +337,39 @@ func (tl *Telnet) TelnetSendText(buffer []byte) {
 	} //for
 
 	// send whatever portion of buffer is left
-	if i != ln {
+	if ln != len(buffer) {
 		tl.send(buffer[ln:])
 	}
 }
 
+//------------------------------------------------------------------------------------------------//
+
+// Begin a subnegotiation; the payload is sent with TelnetSend and
+// the subnegotiation is closed with TelnetFinishSB
+func (tl *Telnet) TelnetBeginSB(telopt byte) {
+	data := []byte{TELNET_IAC, byte(TELNET_SB), telopt}
+	tl.send(data)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Finish a subnegotiation started with TelnetBeginSB
+func (tl *Telnet) TelnetFinishSB() {
+	tl.TelnetIAC(byte(TELNET_SE))
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Send a complete subnegotiation (escapes IAC bytes of the payload).
+// The whole IAC SB ... IAC SE sequence is delivered as a single SEND event.
+func (tl *Telnet) TelnetSubnegotiation(telopt byte, buffer []byte) {
+	data := make([]byte, 0, len(buffer)+5)
+	data = append(data, TELNET_IAC, byte(TELNET_SB), telopt)
+	data = appendEscaped(data, buffer)
+	data = append(data, TELNET_IAC, byte(TELNET_SE))
+	tl.send(data)
+}
+
 //-------------------------------Private functions------------------------------------------------//
 
 func (tl *Telnet) callEventHandler(telnetEvent TelnetEventInterface) {
@@ -189,7 +382,19 @@ func (tl *Telnet) callEventHandler(telnetEvent TelnetEventInterface) {
 //------------------------------------------------------------------------------------------------//
 
 func (tl *Telnet) send(buffer []byte) {
-	ev := NewTelnetSendEvent()
+	// if we have a deflate (compression) zlib box, use it
+	if tl.internalFlags.Contains(int(TELNET_PFLAG_DEFLATE)) {
+		tl.deflate(buffer)
+		return
+	}
+	tl.sendEvent(buffer)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Pass data to the event handler as is, bypassing compression
+func (tl *Telnet) sendEvent(buffer []byte) {
+	ev := tl.newSendEvent()
 	ev.Buffer = buffer
 	tl.callEventHandler(ev)
 }
@@ -197,38 +402,37 @@ func (tl *Telnet) send(buffer []byte) {
 //------------------------------------------------------------------------------------------------//
 
 func (tl *Telnet) process(buffer []byte) {
-	var i, start int
+	var start int
 	var dataByte byte
 
-	for i, dataByte = range buffer {
+	for i := 0; i < len(buffer); i++ {
+		dataByte = buffer[i]
 		switch tl.state {
 		// regular data
 		case TELNET_STATE_DATA:
-			// on an IAC byte, pass through all pending bytes and switch states
+			// skip plain data up to the next IAC or '\r' to be translated
+			n := tl.scanData(buffer[i:])
+			if n < 0 {
+				i = len(buffer)
+				continue
+			}
+			i += n
+			dataByte = buffer[i]
+
+			// pass through all pending bytes and switch states
+			if i > start {
+				tl.dataEvent(buffer[start:i])
+			}
 			if dataByte == byte(TELNET_IAC) {
-				if i != start {
-					dataEvent := NewTelnetDataEvent()
-					dataEvent.Buffer = buffer[start:i]
-					tl.callEventHandler(dataEvent)
-				}
 				tl.state = TELNET_STATE_IAC
-			} else if dataByte == '\r' && (tl.flags.Contains(TELNET_FLAG_NVT_EOL)) && !(tl.internalFlags.Contains(TELNET_FLAG_RECEIVE_BINARY)) {
-				if i != start {
-					dataEvent := NewTelnetDataEvent()
-					dataEvent.Buffer = buffer[start:i]
-					tl.callEventHandler(dataEvent)
-				}
+			} else {
 				tl.state = TELNET_STATE_EOL
 			}
 
 			// NVT EOL to be translated
 		case TELNET_STATE_EOL:
 			if dataByte != '\n' {
-				dataByte = '\r'
-				dataEvent := NewTelnetDataEvent()
-				dataEvent.Buffer = []byte{dataByte}
-				tl.callEventHandler(dataEvent)
-				dataByte = buffer[i]
+				tl.dataEvent(tl.byteBuffer('\r'))
 			}
 			// any byte following '\r' other than '\n' or '\0' is invalid,
 			// so pass both \r and the byte
@@ -258,9 +462,7 @@ func (tl *Telnet) process(buffer []byte) {
 				// IAC escaping
 			case byte(TELNET_IAC):
 				// event
-				dataEvent := NewTelnetDataEvent()
-				dataEvent.Buffer = []byte{dataByte}
-				tl.callEventHandler(dataEvent)
+				tl.dataEvent(tl.byteBuffer(dataByte))
 				// state update
 				start = i + 1
 				tl.state = TELNET_STATE_DATA
@@ -268,9 +470,13 @@ func (tl *Telnet) process(buffer []byte) {
 				// some other command
 			default:
 				// event
-				iacEvent := NewTelnetIacEvent()
-				iacEvent.Cmd = TELNET_IAC
+				iacEvent := tl.newIacEvent()
+				iacEvent.Cmd = TelnetCommands(dataByte)
 				tl.callEventHandler(iacEvent)
+				// answer Are You There
+				if dataByte == byte(TELNET_AYT) && tl.AYTResponse != "" {
+					tl.TelnetSendText([]byte(tl.AYTResponse))
+				}
 				// state update
 				start = i + 1
 				tl.state = TELNET_STATE_DATA
@@ -308,8 +514,8 @@ func (tl *Telnet) process(buffer []byte) {
 				 * just captures and discards MCCPv1 sequences. */
 				start = i + 2
 				tl.state = TELNET_STATE_DATA
-			} else {
-				tl.buffer.Write([]byte{dataByte})
+			} else if !tl.bufferByte(dataByte) {
+				// buffer overflow; subnegotiation is discarded
 				start = i + 1
 				tl.state = TELNET_STATE_DATA
 			}
@@ -343,30 +549,19 @@ func (tl *Telnet) process(buffer []byte) {
 			// escaped IAC byte
 			case byte(TELNET_IAC):
 				// push IAC into buffer
-				/*
-				   if (BufferByte((byte)TelnetCommands.TELNET_IAC) != TelnetErrorCode.TELNET_EOK)
-				   {
-				   start = i + 1;
-				   _state = TelnetState.TELNET_STATE_DATA;
-				   }
-				   else
-				   {
-				   _state = TelnetState.TELNET_STATE_SB_DATA;
-				   }
-				*/
-				tl.buffer.Write([]byte{byte(TELNET_IAC)})
-				tl.state = TELNET_STATE_SB_DATA
+				if !tl.bufferByte(byte(TELNET_IAC)) {
+					start = i + 1
+					tl.state = TELNET_STATE_DATA
+				} else {
+					tl.state = TELNET_STATE_SB_DATA
+				}
 
 			/* something else -- protocol error.  attempt to process
 			 * content in subnegotiation buffer, then evaluate the
 			 * given command as an IAC code.
 			 */
 			default:
-				/* TODO:
-				   _error(Telnet, __LINE__, __func__, TELNET_EPROTOCOL, 0,
-					   "unexpected byte after IAC inside SB: %d",
-					   dataByte);
-				*/
+				tl.raiseError(TELNET_EPROTOCOL, false, "unexpected byte after IAC inside SB: %d", dataByte)
 
 				// enter IAC state
 				start = i + 1
@@ -395,11 +590,51 @@ func (tl *Telnet) process(buffer []byte) {
 
 	// pass through any remaining bytes
 	if tl.state == TELNET_STATE_DATA && start < len(buffer) {
-		dataEvent := NewTelnetDataEvent()
-		dataEvent.Buffer = buffer[start:]
-		tl.callEventHandler(dataEvent)
+		tl.dataEvent(buffer[start:])
+	}
+
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Size of the chunks searched for bytes of interest at once
+const scanWindow = 512
+
+// Find the next byte plain data is interrupted by: IAC, or '\r' when
+// NVT EOL sequences are translated. Returns -1 if there is none.
+func (tl *Telnet) scanData(buffer []byte) int {
+	if !tl.flags.Contains(TELNET_FLAG_NVT_EOL) || tl.internalFlags.Contains(TELNET_FLAG_RECEIVE_BINARY) {
+		return bytes.IndexByte(buffer, byte(TELNET_IAC))
 	}
 
+	// search both bytes window by window, so that a byte missing from
+	// the rest of the buffer is not looked for again after every run
+	for off := 0; off < len(buffer); off += scanWindow {
+		window := buffer[off:]
+		if len(window) > scanWindow {
+			window = window[:scanWindow]
+		}
+		iac := bytes.IndexByte(window, byte(TELNET_IAC))
+		if iac >= 0 {
+			window = window[:iac]
+		}
+		if cr := bytes.IndexByte(window, '\r'); cr >= 0 {
+			return off + cr
+		}
+		if iac >= 0 {
+			return off + iac
+		}
+	}
+	return -1
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// helper for passing received data to the event handler
+func (tl *Telnet) dataEvent(buffer []byte) {
+	dataEvent := tl.newDataEvent()
+	dataEvent.Buffer = buffer
+	tl.callEventHandler(dataEvent)
 }
 
 //------------------------------------------------------------------------------------------------//
@@ -422,6 +657,12 @@ func (tl *Telnet) negotiate(telopt byte) {
 		return
 	}
 
+	// TIMING-MARK is not a stateful option
+	if telopt == byte(TELOPT_TM) {
+		tl.timingMark()
+		return
+	}
+
 	// lookup the current state of the option
 	var q TelnetRFC1143 = tl.getRFC1143(telopt)
 
@@ -442,12 +683,12 @@ func (tl *Telnet) negotiate(telopt byte) {
 		case byte(Q_WANTNO):
 			tl.setRFC1143(telopt, q_US(q), byte(Q_NO))
 			tl.negotiateEvent(TELNET_EV_WONT, telopt)
-			//_error(Telnet, __LINE__, __func__, TELNET_EPROTOCOL, 0, "DONT answered by WILL");
+			tl.raiseError(TELNET_EPROTOCOL, false, "DONT answered by WILL")
 
 		case byte(Q_WANTNO_OP):
 			tl.setRFC1143(telopt, q_US(q), byte(Q_YES))
 			tl.negotiateEvent(TELNET_EV_WILL, telopt)
-			//_error(Telnet, __LINE__, __func__, TELNET_EPROTOCOL, 0, "DONT answered by WILL");
+			tl.raiseError(TELNET_EPROTOCOL, false, "DONT answered by WILL")
 
 		case byte(Q_WANTYES):
 			tl.setRFC1143(telopt, q_US(q), byte(Q_YES))
@@ -493,12 +734,12 @@ func (tl *Telnet) negotiate(telopt byte) {
 		case byte(Q_WANTNO):
 			tl.setRFC1143(telopt, byte(Q_NO), q_HIM(q))
 			tl.negotiateEvent(TELNET_EV_DONT, telopt)
-			//_error(Telnet, __LINE__, __func__, TELNET_EPROTOCOL, 0, "WONT answered by DO");
+			tl.raiseError(TELNET_EPROTOCOL, false, "WONT answered by DO")
 
 		case byte(Q_WANTNO_OP):
 			tl.setRFC1143(telopt, byte(Q_YES), q_HIM(q))
 			tl.negotiateEvent(TELNET_EV_DO, telopt)
-			//_error(Telnet, __LINE__, __func__, TELNET_EPROTOCOL, 0, "WONT answered by DO");
+			tl.raiseError(TELNET_EPROTOCOL, false, "WONT answered by DO")
 
 		case byte(Q_WANTYES):
 			tl.setRFC1143(telopt, byte(Q_YES), q_HIM(q))
@@ -533,8 +774,25 @@ func (tl *Telnet) negotiate(telopt byte) {
 			tl.setRFC1143(telopt, byte(Q_NO), q_HIM(q))
 		}
 	} //switch
+
+	tl.optionChanged(telopt, q)
 }
 
+//------------------------------------------------------------------------------------------------//
+
+// Called once the peer has agreed to an option we perform
+func (tl *Telnet) localEnabled(telopt byte) {
+	switch telopt {
+	// announce server status to MSSP crawler
+	case byte(TELOPT_MSSP):
+		if len(tl.MSSP) != 0 {
+			tl.TelnetSendMSSP(tl.MSSP)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
 // Process a subnegotiation buffer; return non-zero if the current buffer
 // must be aborted and reprocessed due to COMPRESS2 being activated
 func (tl *Telnet) subnegotiate() bool {
@@ -543,68 +801,104 @@ func (tl *Telnet) subnegotiate() bool {
 	subnEvent.Buffer = tl.buffer.Bytes()
 	tl.callEventHandler(subnEvent)
 
+	if handler, ok := tl.handlers[tl.sb_telopt]; ok {
+		handler.OnSubnegotiation(tl, tl.buffer.Bytes())
+	}
+
 	switch tl.sb_telopt {
 	// specially handled subnegotiation telopt types
 	case byte(TELOPT_ZMP):
-		//TODO: return ZMPTelnet();
+		tl.zmpTelnet(tl.buffer.Bytes())
 	case byte(TELOPT_TTYPE):
-		//TODO: return TTypeTelnet();
-		/*
-			case (byte)TelnetOptions.TELOPT_OLD_ENVIRON:
-			case (byte)TelnetOptions.TELOPT_NEW_ENVIRON:
-				return _environ_telnet(_sb_telopt, _buffer, _buffer_pos);
-		*/
+		tl.ttypeTelnet(tl.buffer.Bytes())
+	case byte(TELOPT_OLD_ENVIRON), byte(TELOPT_NEW_ENVIRON):
+		tl.environTelnet(tl.sb_telopt, tl.buffer.Bytes())
 	case byte(TELOPT_MSSP):
-		//TODO: return MSSPTelnet();
+		tl.msspTelnet(tl.buffer.Bytes())
+	case byte(TELOPT_STATUS):
+		tl.statusTelnet(tl.buffer.Bytes())
+	case byte(TELOPT_NAWS):
+		tl.nawsTelnet(tl.buffer.Bytes())
+
+	// received COMPRESS2 or MCCP3 begin marker, setup our zlib box and
+	// start handling the compressed stream if it's not already.
+	case byte(TELOPT_COMPRESS2), byte(TELOPT_MCCP3):
+		if tl.inflater != nil {
+			tl.raiseError(TELNET_EBADVAL, false, "cannot initialize compression twice")
+			return false
+		}
+		// COMPRESS2 is sent by the peer performing it, MCCP3 by the
+		// peer agreed to our offer
+		if !tl.flags.Contains(int(TELNET_FLAG_PROXY)) {
+			q := tl.getRFC1143(tl.sb_telopt)
+			if (tl.sb_telopt == TELOPT_COMPRESS2 && q_HIM(q) != byte(Q_YES)) || (tl.sb_telopt == TELOPT_MCCP3 && q_US(q) != byte(Q_YES)) {
+				tl.raiseError(TELNET_EPROTOCOL, false, "telopt %d compression was not negotiated", tl.sb_telopt)
+				return false
+			}
+		}
+		tl.inflater = newInflateStream(tl.sb_telopt)
+
+		// notify app that compression was enabled
+		tl.compressEvent(tl.sb_telopt, false, true)
+		return true
 	}
 	return false
 }
 
 //------------------------------------------------------------------------------------------------//
 
+// Push a byte into the subnegotiation buffer; on overflow the buffer
+// is discarded and false is returned
+func (tl *Telnet) bufferByte(dataByte byte) bool {
+	// check if we're out of room
+	if tl.MaxSubnegotiation > 0 && tl.buffer.Len() >= tl.MaxSubnegotiation {
+		tl.raiseError(TELNET_EOVERFLOW, false, "subnegotiation buffer size limit reached")
+		tl.buffer.Reset()
+		return false
+	}
+
+	tl.buffer.WriteByte(dataByte)
+	return true
+}
+
+//------------------------------------------------------------------------------------------------//
+
 // Retrieve RFC1143 option state
 func (tl *Telnet) getRFC1143(telopt byte) TelnetRFC1143 {
+	return TelnetRFC1143{telopt: telopt, state: tl.rfc1143[telopt]}
+}
+
+//------------------------------------------------------------------------------------------------//
 
-	// search for entry
-	for _, v := range tl.rfc1143List {
-		if v.telopt == telopt {
-			return v
+// Check if any option negotiation is waiting for the peer's answer
+func (tl *Telnet) negotiating() bool {
+	for i := range tl.rfc1143 {
+		q := tl.getRFC1143(byte(i))
+		if (q_US(q) != byte(Q_NO) && q_US(q) != byte(Q_YES)) || (q_HIM(q) != byte(Q_NO) && q_HIM(q) != byte(Q_YES)) {
+			return true
 		}
 	}
-
-	// not found, return empty value
-	return TelnetRFC1143{telopt: telopt, state: 0}
+	return false
 }
 
 //------------------------------------------------------------------------------------------------//
 
 // Save RFC1143 option state
 func (tl *Telnet) setRFC1143(telopt byte, us byte, him byte) {
-	var qtmp TelnetRFC1143
-
-	// search for entry
-	for i, _ := range tl.rfc1143List {
-		if tl.rfc1143List[i].telopt == telopt {
-			qtmp = TelnetRFC1143{state: q_MAKE(us, him), telopt: telopt}
-			tl.rfc1143List[i] = qtmp
-			if telopt != byte(TELOPT_BINARY) {
-				return
-			}
-			tl.internalFlags.Delete(int(TELNET_FLAG_TRANSMIT_BINARY))
-			tl.internalFlags.Delete(int(TELNET_FLAG_RECEIVE_BINARY))
-			if us == byte(Q_YES) {
-				tl.internalFlags.Add(int(TELNET_FLAG_TRANSMIT_BINARY))
-			}
-			if him == byte(Q_YES) {
-				tl.internalFlags.Add(int(TELNET_FLAG_RECEIVE_BINARY))
-			}
-			return
-		}
-	}
+	tl.rfc1143[telopt] = q_MAKE(us, him)
 
-	qtmp.telopt = telopt
-	qtmp.state = q_MAKE(us, him)
-	tl.rfc1143List = append(tl.rfc1143List, qtmp)
+	// keep binary mode flags in sync with BINARY option state
+	if telopt != byte(TELOPT_BINARY) {
+		return
+	}
+	tl.internalFlags.Delete(int(TELNET_FLAG_TRANSMIT_BINARY))
+	tl.internalFlags.Delete(int(TELNET_FLAG_RECEIVE_BINARY))
+	if us == byte(Q_YES) {
+		tl.internalFlags.Add(int(TELNET_FLAG_TRANSMIT_BINARY))
+	}
+	if him == byte(Q_YES) {
+		tl.internalFlags.Add(int(TELNET_FLAG_RECEIVE_BINARY))
+	}
 }
 
 //------------------------------------------------------------------------------------------------//
@@ -613,6 +907,14 @@ func (tl *Telnet) setRFC1143(telopt byte, us byte, him byte) {
 // check if we(local) supports it, otherwise we check if he(remote)
 // supports it.  return non-zero if supported, zero if not supported.
 func (tl *Telnet) checkTelOpt(telopt byte, us bool) bool {
+	// registered handler decides by itself
+	if handler, ok := tl.handlers[telopt]; ok {
+		if us {
+			return handler.AcceptLocal(tl)
+		}
+		return handler.AcceptRemote(tl)
+	}
+
 	// if we have no telopts table, we obviously don't support it
 	if len(tl.telOpts) == 0 {
 		return false
@@ -623,7 +925,7 @@ func (tl *Telnet) checkTelOpt(telopt byte, us bool) bool {
 		if byte(v.TelOpt) == telopt {
 			if us && v.Us == TELNET_WILL {
 				return true
-			} else if us && v.Him == TELNET_DO {
+			} else if !us && v.Him == TELNET_DO {
 				return true
 			} else {
 				return false
@@ -639,15 +941,42 @@ func (tl *Telnet) checkTelOpt(telopt byte, us bool) bool {
 
 // Send negotiation bytes
 func (tl *Telnet) sendNegotiate(cmd TelnetCommands, telopt byte) {
-	data := []byte{TELNET_IAC, byte(cmd), telopt}
+	data := tl.commandBuffer(3)
+	data[0] = TELNET_IAC
+	data[1] = byte(cmd)
+	data[2] = telopt
 	tl.send(data)
 }
 
 //------------------------------------------------------------------------------------------------//
 
+// Report a problem to the event handler: WARNING for recoverable
+// errors, ERROR for fatal ones
+func (tl *Telnet) raiseError(code TelnetErrorCode, fatal bool, format string, args ...interface{}) {
+	ee := NewTelnetErrorEvent(fatal)
+	ee.Code = code
+	ee.Message = fmt.Sprintf(format, args...)
+	tl.callEventHandler(ee)
+}
+
+//------------------------------------------------------------------------------------------------//
+
 // helper for the negotiation routines
 func (tl *Telnet) negotiateEvent(EventType TelnetEventType, opt byte) {
-	ne := NewTelnetNegotiateEvent(EventType)
+	ne := tl.newNegotiateEvent(EventType)
 	ne.TelOpt = TelnetOptions(opt)
 	tl.callEventHandler(ne)
 }
+
+//------------------------------------------------------------------------------------------------//
+
+// Append buffer to dst doubling every IAC byte
+func appendEscaped(dst []byte, buffer []byte) []byte {
+	for _, b := range buffer {
+		if b == byte(TELNET_IAC) {
+			dst = append(dst, TELNET_IAC)
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
@@ -0,0 +1,104 @@
+package pactelnet
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Client side settings of Dial and DialConn
+type ClientConfig struct {
+	// Options requested from the server (Him == TELNET_DO) and
+	// offered to it (Us == TELNET_WILL)
+	Options []TelnetOptionReq
+	// Flags of the state tracker
+	Flags []TelnetFlags
+	// Terminal types reported on TERMINAL-TYPE requests; TTYPE is
+	// offered unless Options has an entry for it
+	TerminalTypes []string
+	// Window size reported once the server agrees to NAWS; zero if
+	// unknown. NAWS is offered unless Options has an entry for it.
+	Width  uint16
+	Height uint16
+	// Interval of IAC NOP keepalives sent once connected; zero disables them
+	Keepalive time.Duration
+	// Called for every event except DATA and SEND, see Conn.OnEvent
+	OnEvent func(tl *Telnet, telnetEvent TelnetEventInterface)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Connect to the TCP address and perform the initial option exchange.
+// Returns once all requests are answered; if ctx is done first, the
+// connection is closed and ctx error is returned.
+func Dial(ctx context.Context, addr string, config *ClientConfig) (*Conn, error) {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := DialConn(ctx, nc, config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Perform the initial option exchange over an established connection;
+// nc is not closed on failure
+func DialConn(ctx context.Context, nc net.Conn, config *ClientConfig) (*Conn, error) {
+	if config == nil {
+		config = &ClientConfig{}
+	}
+
+	options := config.Options
+	if len(config.TerminalTypes) != 0 {
+		options = offerOption(options, TELOPT_TTYPE)
+	}
+	if config.Width != 0 || config.Height != 0 {
+		options = offerOption(options, TELOPT_NAWS)
+	}
+
+	conn := NewConn(nc, options, config.Flags)
+	conn.telnet.TerminalTypes = config.TerminalTypes
+	conn.OnEvent = func(tl *Telnet, telnetEvent TelnetEventInterface) {
+		// report window size as soon as the server asks for it
+		if config.Width != 0 || config.Height != 0 {
+			if ne, ok := telnetEvent.(*TelnetNegotiateEvent); ok && ne.EventType() == TELNET_EV_DO && ne.TelOpt == TELOPT_NAWS {
+				tl.TelnetSendNaws(config.Width, config.Height)
+			}
+		}
+		if config.OnEvent != nil {
+			config.OnEvent(tl, telnetEvent)
+		}
+	}
+
+	if err := conn.Negotiate(ctx); err != nil {
+		conn.Do(func(tl *Telnet) {
+			tl.TelnetClose()
+		})
+		return nil, err
+	}
+	if config.Keepalive > 0 {
+		conn.Keepalive(config.Keepalive, TELNET_NOP)
+	}
+	return conn, nil
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Add WILL entry for the option to a copy of the table unless the
+// option is already listed
+func offerOption(options []TelnetOptionReq, telopt TelnetOptions) []TelnetOptionReq {
+	for _, v := range options {
+		if v.TelOpt == telopt {
+			return options
+		}
+	}
+	offered := make([]TelnetOptionReq, len(options), len(options)+1)
+	copy(offered, options)
+	return append(offered, TelnetOptionReq{TelOpt: telopt, Us: TELNET_WILL, Him: TELNET_DONT})
+}
@@ -1,10 +1,15 @@
 package pactelnet
 
+import "fmt"
+
 type (
 	TelnetCommands  byte
 	TelnetOptions   byte
 	TelnetEventType byte
 	TelnetMSSP      byte
+	TelnetTType     byte
+	TelnetEnviron   byte
+	TelnetStatus    byte
 	TelnetFlags     byte
 
 	TelnetOptionReq struct {
@@ -16,13 +21,29 @@ type (
 		Him TelnetCommands
 	}
 
+	// NEW-ENVIRON/OLD-ENVIRON variable
+	TelnetEnvironValue struct {
+		// TELNET_ENVIRON_VAR or TELNET_ENVIRON_USERVAR
+		Type TelnetEnviron
+		// Variable name
+		Name string
+		// Variable value, empty if not given
+		Value string
+		// No value is given: the variable is undefined, as opposed to
+		// defined with an empty value; always set in SEND requests
+		Undefined bool
+	}
+
+	// MSSP variable; one variable may carry several values
 	MSSPPair struct {
-		variable []byte
-		value    []byte
+		Name   string
+		Values []string
 	}
 )
 
 const (
+	// End of record (RFC 885), sent when TELOPT_EOR is enabled.
+	TELNET_EOR TelnetCommands = 239
 	// End of subnegotiation parameters.
 	TELNET_SE TelnetCommands = 240
 	// No operation.
@@ -60,6 +81,33 @@ const (
 	TELNET_IAC = 255
 )
 
+var commandNames = map[TelnetCommands]string{
+	TELNET_EOR:  "EOR",
+	TELNET_SE:   "SE",
+	TELNET_NOP:  "NOP",
+	TELNET_DM:   "DM",
+	TELNET_BRK:  "BRK",
+	TELNET_IP:   "IP",
+	TELNET_AO:   "AO",
+	TELNET_AYT:  "AYT",
+	TELNET_EC:   "EC",
+	TELNET_EL:   "EL",
+	TELNET_GA:   "GA",
+	TELNET_SB:   "SB",
+	TELNET_WILL: "WILL",
+	TELNET_WONT: "WONT",
+	TELNET_DO:   "DO",
+	TELNET_DONT: "DONT",
+	TELNET_IAC:  "IAC",
+}
+
+func (cmd TelnetCommands) String() string {
+	if name, ok := commandNames[cmd]; ok {
+		return name
+	}
+	return fmt.Sprintf("TelnetCommands(%d)", byte(cmd))
+}
+
 const (
 	// 8-bit data path
 	TELOPT_BINARY TelnetOptions = 0
@@ -129,6 +177,8 @@ const (
 	TELOPT_COMPRESS  = 85
 	TELOPT_COMPRESS2 = 86
 	TELOPT_MCCP2     = 86
+	// Client to server compression
+	TELOPT_MCCP3 = 87
 	// ZMud protocol
 	TELOPT_ZMP              = 93
 	TELOPT_PRAGMA_LOGON     = 138
@@ -143,6 +193,33 @@ const (
 	MSSP_VAL            = 2
 )
 
+// Protocol codes for TERMINAL-TYPE commands.
+const (
+	TELNET_TTYPE_IS   TelnetTType = 0
+	TELNET_TTYPE_SEND             = 1
+)
+
+// Protocol codes for STATUS commands.
+const (
+	TELNET_STATUS_IS   TelnetStatus = 0
+	TELNET_STATUS_SEND              = 1
+)
+
+// Protocol codes for NEW-ENVIRON/OLD-ENVIRON commands.
+const (
+	TELNET_ENVIRON_IS   TelnetEnviron = 0
+	TELNET_ENVIRON_SEND               = 1
+	TELNET_ENVIRON_INFO               = 2
+)
+
+// Protocol codes for NEW-ENVIRON/OLD-ENVIRON variable types.
+const (
+	TELNET_ENVIRON_VAR     TelnetEnviron = 0
+	TELNET_ENVIRON_VALUE                 = 1
+	TELNET_ENVIRON_ESC                   = 2
+	TELNET_ENVIRON_USERVAR               = 3
+)
+
 const (
 	TELNET_EV_DATA           TelnetEventType = iota /*!< raw text data has been received */
 	TELNET_EV_SEND                                  /*!< data needs to be sent to the peer */
@@ -159,8 +236,14 @@ const (
 	TELNET_EV_MSSP                                  /*!< MSSP command has been received */
 	TELNET_EV_WARNING                               /*!< recoverable error has occured */
 	TELNET_EV_ERROR                                 /*!< non-recoverable error has occured */
+	TELNET_EV_TIMING_MARK                           /*!< reply to DO TIMING-MARK has been received */
+	TELNET_EV_STATUS                                /*!< STATUS command has been received */
+	TELNET_EV_NAWS                                  /*!< window size has been received */
 )
 
+// Default limit of subnegotiation data size, see Telnet.MaxSubnegotiation
+const TELNET_DEFAULT_SB_SIZE = 16384
+
 // Control behavior of telnet state tracker.
 const (
 	// Operate in proxy mode.  This disables the RFC1143 support and
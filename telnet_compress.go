@@ -0,0 +1,251 @@
+package pactelnet
+
+import (
+	"compress/zlib"
+	"io"
+	"runtime"
+	"sync"
+)
+
+type (
+	// Inflating side of a compressed stream. zlib offers only a pull
+	// interface, so the decompressor runs in its own goroutine and is
+	// driven synchronously from TelnetRecv: every chunk handed over
+	// with wake is answered by one or more results on yield.
+	inflateStream struct {
+		telopt byte
+		wake   chan []byte
+		yield  chan inflateResult
+		stop   sync.Once
+	}
+
+	// Input of the decompressor, owned by its goroutine. It shares
+	// only the channels with inflateStream, so the stream can be
+	// finalized while the goroutine is still waiting for data.
+	inflateReader struct {
+		wake    <-chan []byte
+		yield   chan<- inflateResult
+		pending []byte
+	}
+
+	inflateResult struct {
+		// inflated bytes, valid until the stream is woken again
+		data []byte
+		// all input consumed, more compressed data required
+		more bool
+		// io.EOF on the end of compressed stream, any other value on failure
+		err error
+		// bytes following the end of compressed stream
+		rest []byte
+	}
+)
+
+// Start the decompressor goroutine. It is stopped by close, or when
+// the stream is garbage collected, e.g. together with a state tracker
+// abandoned without TelnetClose.
+func newInflateStream(telopt byte) *inflateStream {
+	z := &inflateStream{
+		telopt: telopt,
+		wake:   make(chan []byte),
+		yield:  make(chan inflateResult),
+	}
+	r := &inflateReader{wake: z.wake, yield: z.yield}
+	go r.run()
+	runtime.SetFinalizer(z, (*inflateStream).close)
+	return z
+}
+
+//------------------------------------------------------------------------------------------------//
+
+func (r *inflateReader) run() {
+	defer close(r.yield)
+
+	var ok bool
+	if r.pending, ok = <-r.wake; !ok {
+		return
+	}
+
+	zr, err := zlib.NewReader(r)
+	if err == nil {
+		buf := make([]byte, 4096)
+		for {
+			var n int
+			n, err = zr.Read(buf)
+			if n > 0 {
+				r.yield <- inflateResult{data: buf[:n]}
+				<-r.wake
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	r.yield <- inflateResult{err: err, rest: r.pending}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Wait for the next chunk of compressed input
+func (r *inflateReader) fill() error {
+	for len(r.pending) == 0 {
+		r.yield <- inflateResult{more: true}
+		var ok bool
+		if r.pending, ok = <-r.wake; !ok {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
+
+// Read implements io.Reader for the decompressor
+func (r *inflateReader) Read(p []byte) (int, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// ReadByte implements io.ByteReader, so the decompressor never reads
+// past the end of compressed stream
+func (r *inflateReader) ReadByte() (byte, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	b := r.pending[0]
+	r.pending = r.pending[1:]
+	return b, nil
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Stop the decompressor goroutine; safe to call more than once
+func (z *inflateStream) close() {
+	z.stop.Do(func() {
+		close(z.wake)
+		for range z.yield {
+		}
+	})
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Inflate received data and process the result
+func (tl *Telnet) inflate(buffer []byte) {
+	z := tl.inflater
+	z.wake <- buffer
+
+	for {
+		r := <-z.yield
+		if r.more {
+			return
+		}
+		if r.data != nil {
+			tl.process(r.data)
+			// the stream may be released from the event handler
+			if tl.inflater != z {
+				return
+			}
+			z.wake <- nil
+			continue
+		}
+
+		// on error (or on end of stream) disable further inflation
+		tl.inflater = nil
+		z.close()
+		if r.err != io.EOF {
+			tl.raiseError(TELNET_ECOMPRESS, true, "inflate failed: %v", r.err)
+		}
+		tl.compressEvent(z.telopt, false, false)
+
+		// data after the end of compressed stream is not compressed
+		if r.err == io.EOF && len(r.rest) != 0 {
+			tl.process(r.rest)
+		}
+		return
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Start compressing everything passed to send()
+func (tl *Telnet) beginDeflate(telopt byte) {
+	tl.deflateTelOpt = telopt
+	tl.deflateBuffer.Reset()
+	tl.deflater = zlib.NewWriter(&tl.deflateBuffer)
+	tl.internalFlags.Add(int(TELNET_PFLAG_DEFLATE))
+
+	// notify app that compression was enabled
+	tl.compressEvent(telopt, true, true)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Finish compressed stream, so the peer returns to plain data
+func (tl *Telnet) endDeflate() {
+	if !tl.internalFlags.Contains(int(TELNET_PFLAG_DEFLATE)) {
+		return
+	}
+
+	// pending output is sent with the end of stream
+	tl.deflater.Close()
+	tl.deflater = nil
+	tl.deflateDirty = false
+	tl.internalFlags.Delete(int(TELNET_PFLAG_DEFLATE))
+	data := tl.deflateBuffer.Bytes()
+	tl.deflateBuffer.Reset()
+	tl.sendEvent(data)
+
+	tl.compressEvent(tl.deflateTelOpt, true, false)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Compress data. Output of a public call is passed to the event
+// handler as one chunk once the call is done, see beginOutput.
+// Writes into bytes.Buffer never fail, so do zlib writes.
+func (tl *Telnet) deflate(buffer []byte) {
+	tl.deflater.Write(buffer)
+	tl.deflateDirty = true
+	if tl.outputDepth == 0 {
+		tl.flushDeflate()
+	}
+}
+
+// Flush compressed data with Z_SYNC_FLUSH, so the peer can inflate it
+// immediately, and pass it to the event handler
+func (tl *Telnet) flushDeflate() {
+	tl.deflater.Flush()
+	tl.deflateDirty = false
+	data := tl.deflateBuffer.Bytes()
+	tl.deflateBuffer.Reset()
+	tl.sendEvent(data)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Group output of a public call, so that compressed output is flushed
+// once per call instead of once per escaped or translated fragment.
+// Calls may be nested; output is flushed when the outermost one ends.
+func (tl *Telnet) beginOutput() {
+	tl.outputDepth++
+}
+
+func (tl *Telnet) endOutput() {
+	tl.outputDepth--
+	if tl.outputDepth == 0 && tl.deflateDirty {
+		tl.flushDeflate()
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// helper for the compression routines
+func (tl *Telnet) compressEvent(telopt byte, outbound bool, state bool) {
+	ce := NewTelnetCompressEvent()
+	ce.TelOpt = TelnetOptions(telopt)
+	ce.Outbound = outbound
+	ce.State = state
+	tl.callEventHandler(ce)
+}
@@ -0,0 +1,398 @@
+package pactelnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Telnet connection over net.Conn or any other io.ReadWriter.
+// Read returns application data with telnet commands removed, Write
+// escapes IAC bytes; all other events are passed to OnEvent.
+type Conn struct {
+	rw     io.ReadWriter
+	telnet *Telnet
+	// guards telnet, data and out
+	mu sync.Mutex
+	// serializes writes to rw, guards werr; taken before mu is
+	// released, so output is written in the order it was produced
+	wmu sync.Mutex
+	// serializes Read calls, guards readBuf and rerr
+	rmu     sync.Mutex
+	data    bytes.Buffer
+	out     []byte
+	readBuf []byte
+	rerr    error
+	werr    error
+	// stops the keepalive goroutine, guarded by mu
+	keepaliveStop chan struct{}
+	// time data was last received from the peer, guarded by mu
+	lastReceive time.Time
+	// Called for every event except DATA and SEND. The state tracker
+	// is locked during the call, so it is safe to use it here.
+	OnEvent func(tl *Telnet, telnetEvent TelnetEventInterface)
+}
+
+// Past deadline used to interrupt blocked reads
+var aLongTimeAgo = time.Unix(1, 0)
+
+var errDeadlineNotSupported = errors.New("pactelnet: deadlines are not supported by the underlying connection")
+
+func NewConn(rw io.ReadWriter, options []TelnetOptionReq, flags []TelnetFlags) *Conn {
+	c := new(Conn)
+	c.rw = rw
+	c.readBuf = make([]byte, 4096)
+	c.telnet = NewTelnet(options, flags, c)
+	c.telnet.OnTelnetEvent = c.handleEvent
+	return c
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Run fn with exclusive access to the state tracker, e.g. to start
+// negotiation. Returns the error of writing the produced data.
+func (c *Conn) Do(fn func(tl *Telnet)) error {
+	c.mu.Lock()
+	fn(c.telnet)
+	return c.flush()
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Check if we perform the option, see Telnet.LocalEnabled
+func (c *Conn) LocalEnabled(telopt byte) bool {
+	return c.OptionState(telopt).Us() == Q_YES
+}
+
+// Check if the peer performs the option, see Telnet.RemoteEnabled
+func (c *Conn) RemoteEnabled(telopt byte) bool {
+	return c.OptionState(telopt).Him() == Q_YES
+}
+
+// Get RFC1143 state of the option, see Telnet.OptionState
+func (c *Conn) OptionState(telopt byte) TelnetRFC1143 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.telnet.OptionState(telopt)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Read application data received from the peer
+func (c *Conn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for {
+		c.mu.Lock()
+		if c.data.Len() != 0 {
+			n, _ := c.data.Read(p)
+			c.mu.Unlock()
+			return n, nil
+		}
+		c.mu.Unlock()
+
+		// read error is reported once buffered data is consumed
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+		c.rerr = c.receive()
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Offer options from the option table (WILL for Us == TELNET_WILL, DO for
+// Him == TELNET_DO) and wait until the peer answers all of them or ctx
+// is done. TIMING-MARK is only answered, never offered. Data received
+// meanwhile is kept for Read. Waiting can be interrupted only if the
+// underlying connection supports deadlines; the read deadline is
+// cleared on return.
+func (c *Conn) Negotiate(ctx context.Context) error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	err := c.Do(func(tl *Telnet) {
+		for _, v := range tl.telOpts {
+			if v.TelOpt == TELOPT_TM {
+				continue
+			}
+			if v.Us == TELNET_WILL {
+				tl.TelnetNegotiate(TELNET_WILL, byte(v.TelOpt))
+			}
+			if v.Him == TELNET_DO {
+				tl.TelnetNegotiate(TELNET_DO, byte(v.TelOpt))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// interrupt blocked reads when ctx is done
+	done := make(chan struct{})
+	watcher := make(chan struct{})
+	go func() {
+		defer close(watcher)
+		select {
+		case <-ctx.Done():
+			c.SetReadDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-watcher
+		c.SetReadDeadline(time.Time{})
+	}()
+
+	for c.rerr == nil {
+		c.mu.Lock()
+		negotiating := c.telnet.negotiating()
+		c.mu.Unlock()
+		if !negotiating {
+			return nil
+		}
+
+		if err := c.receive(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.rerr = err
+		}
+	}
+	return c.rerr
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Read from the underlying connection once and process received bytes.
+// Must be called with rmu held.
+func (c *Conn) receive() error {
+	n, err := c.rw.Read(c.readBuf)
+	if n > 0 {
+		c.mu.Lock()
+		c.lastReceive = time.Now()
+		c.telnet.TelnetRecv(c.readBuf[:n])
+		// replies to the peer
+		c.flush()
+	}
+	return err
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Send application data to the peer
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.telnet.TelnetSend(p)
+	if err := c.flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Send a telnet command such as TELNET_IP, TELNET_AYT or TELNET_GA
+func (c *Conn) SendCommand(cmd TelnetCommands) error {
+	return c.Do(func(tl *Telnet) {
+		tl.TelnetIAC(byte(cmd))
+	})
+}
+
+// Send Interrupt Process (IP)
+func (c *Conn) InterruptProcess() error {
+	return c.SendCommand(TELNET_IP)
+}
+
+// Send Abort Output (AO)
+func (c *Conn) AbortOutput() error {
+	return c.SendCommand(TELNET_AO)
+}
+
+// Send Are You There (AYT)
+func (c *Conn) AreYouThere() error {
+	return c.SendCommand(TELNET_AYT)
+}
+
+// Send Erase Character (EC)
+func (c *Conn) EraseCharacter() error {
+	return c.SendCommand(TELNET_EC)
+}
+
+// Send Erase Line (EL)
+func (c *Conn) EraseLine() error {
+	return c.SendCommand(TELNET_EL)
+}
+
+// Send NVT Break (BRK)
+func (c *Conn) Break() error {
+	return c.SendCommand(TELNET_BRK)
+}
+
+// Send Go Ahead (GA)
+func (c *Conn) GoAhead() error {
+	return c.SendCommand(TELNET_GA)
+}
+
+// Send No Operation (NOP)
+func (c *Conn) NoOperation() error {
+	return c.SendCommand(TELNET_NOP)
+}
+
+// Send End of Record (EOR); the peer must have agreed to DO EOR
+func (c *Conn) EndOfRecord() error {
+	return c.SendCommand(TELNET_EOR)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Send cmd (TELNET_NOP or TELNET_AYT) every interval until Close, so
+// idle sessions are kept open by NATs. The connection is closed on the
+// first write error. With TELNET_AYT dead peers are detected as well:
+// if nothing was received from the peer since the previous AYT, the
+// connection is closed. Replies are seen only while the connection is
+// read, and the peer has to answer AYT. Replaces the previous
+// keepalive; zero interval stops it.
+func (c *Conn) Keepalive(interval time.Duration, cmd TelnetCommands) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopKeepalive()
+	if interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	c.keepaliveStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var sent time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				// AYT was not answered within the interval
+				if cmd == TELNET_AYT && !sent.IsZero() && !c.receivedSince(sent) {
+					c.Close()
+					return
+				}
+				sent = time.Now()
+				if err := c.SendCommand(cmd); err != nil {
+					c.Close()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Check if anything was received from the peer after t
+func (c *Conn) receivedSince(t time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.lastReceive.Before(t)
+}
+
+// Must be called with mu held
+func (c *Conn) stopKeepalive() {
+	if c.keepaliveStop != nil {
+		close(c.keepaliveStop)
+		c.keepaliveStop = nil
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Close the connection and release the state tracker
+func (c *Conn) Close() error {
+	// closing first unblocks pending reads and writes
+	var err error
+	if closer, ok := c.rw.(io.Closer); ok {
+		err = closer.Close()
+	}
+
+	c.mu.Lock()
+	c.stopKeepalive()
+	c.telnet.TelnetClose()
+	c.mu.Unlock()
+	return err
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Local address of the underlying net.Conn, nil for other connections
+func (c *Conn) LocalAddr() net.Addr {
+	if nc, ok := c.rw.(net.Conn); ok {
+		return nc.LocalAddr()
+	}
+	return nil
+}
+
+// Remote address of the underlying net.Conn, nil for other connections
+func (c *Conn) RemoteAddr() net.Addr {
+	if nc, ok := c.rw.(net.Conn); ok {
+		return nc.RemoteAddr()
+	}
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if nc, ok := c.rw.(net.Conn); ok {
+		return nc.SetDeadline(t)
+	}
+	return errDeadlineNotSupported
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	if nc, ok := c.rw.(net.Conn); ok {
+		return nc.SetReadDeadline(t)
+	}
+	return errDeadlineNotSupported
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	if nc, ok := c.rw.(net.Conn); ok {
+		return nc.SetWriteDeadline(t)
+	}
+	return errDeadlineNotSupported
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Write output produced by the state tracker. Must be called with mu
+// held, which is released. The first write error is kept and returned
+// from all following calls, the rest of output is dropped.
+func (c *Conn) flush() error {
+	out := c.out
+	c.out = nil
+	c.wmu.Lock()
+	c.mu.Unlock()
+	defer c.wmu.Unlock()
+
+	if c.werr == nil && len(out) != 0 {
+		_, c.werr = c.rw.Write(out)
+	}
+	return c.werr
+}
+
+//------------------------------------------------------------------------------------------------//
+
+func (c *Conn) handleEvent(telnetEvent TelnetEventInterface) {
+	switch telnetEvent.EventType() {
+	case TELNET_EV_DATA:
+		c.data.Write(telnetEvent.(*TelnetDataEvent).Buffer)
+	case TELNET_EV_SEND:
+		c.out = append(c.out, telnetEvent.(*TelnetSendEvent).Buffer...)
+	default:
+		if c.OnEvent != nil {
+			c.OnEvent(c.telnet, telnetEvent)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package pactelnet
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnPipe(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server := NewConn(serverSide, []TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WILL, Him: TELNET_DONT}}, nil)
+	client := NewConn(clientSide, []TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WONT, Him: TELNET_DO}}, nil)
+
+	var negotiated []TelnetEventType
+	client.OnEvent = func(tl *Telnet, telnetEvent TelnetEventInterface) {
+		negotiated = append(negotiated, telnetEvent.EventType())
+	}
+
+	// server has to read to receive negotiation replies
+	serverDone := make(chan []byte)
+	go func() {
+		rsvData, _ := io.ReadAll(server)
+		serverDone <- rsvData
+	}()
+	go func() {
+		server.Do(func(tl *Telnet) {
+			tl.TelnetNegotiate(TELNET_WILL, TELOPT_ECHO)
+		})
+		server.Write([]byte("hello \xff world"))
+	}()
+
+	rsvData := make([]byte, 13)
+	if _, err := io.ReadFull(client, rsvData); err != nil {
+		t.Fatal(err)
+	}
+	if string(rsvData) != "hello \xff world" {
+		t.Errorf("Received data %q not equal with expected", rsvData)
+	}
+	if len(negotiated) != 1 || negotiated[0] != TELNET_EV_WILL {
+		t.Errorf("Unexpected negotiation events %v", negotiated)
+	}
+
+	client.Write([]byte("\xffbye"))
+	client.Close()
+	if rsvData := <-serverDone; string(rsvData) != "\xffbye" {
+		t.Errorf("Received data %q not equal with expected", rsvData)
+	}
+	server.Close()
+}
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{
+		Options: []TelnetOptionReq{
+			{TelOpt: TELOPT_ECHO, Us: TELNET_WILL, Him: TELNET_DONT},
+			{TelOpt: TELOPT_NAWS, Us: TELNET_WONT, Him: TELNET_DO},
+		},
+		NegotiationTimeout: 2 * time.Second,
+	}
+	negotiated := make(chan []TelnetEventType, 1)
+	server.OnConnect = func(conn *Conn) {
+		var events []TelnetEventType
+		conn.OnEvent = func(tl *Telnet, telnetEvent TelnetEventInterface) {
+			events = append(events, telnetEvent.EventType())
+			if len(events) == 2 {
+				negotiated <- events
+			}
+		}
+	}
+	server.Handler = func(ctx context.Context, conn *Conn) {
+		conn.Write([]byte("welcome\n"))
+		<-ctx.Done()
+		conn.Write([]byte("bye\n"))
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewConn(nc, []TelnetOptionReq{
+		{TelOpt: TELOPT_ECHO, Us: TELNET_WONT, Him: TELNET_DO},
+		{TelOpt: TELOPT_NAWS, Us: TELNET_WILL, Him: TELNET_DONT},
+	}, nil)
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	if line, err := reader.ReadString('\n'); err != nil || line != "welcome\n" {
+		t.Fatalf("Unexpected greeting %q: %v", line, err)
+	}
+	// handler starts after negotiation settled
+	select {
+	case events := <-negotiated:
+		if events[0] != TELNET_EV_DO || events[1] != TELNET_EV_WILL {
+			t.Errorf("Unexpected negotiation events %v", events)
+		}
+	default:
+		t.Errorf("Negotiation was not finished before the handler")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := reader.ReadString('\n'); line != "bye\n" {
+		t.Errorf("Session was not drained, got %q", line)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// event buffers are valid only during the callback
+	subnegotiations := make(chan interface{}, 2)
+	server := &Server{
+		Options: []TelnetOptionReq{
+			{TelOpt: TELOPT_ECHO, Us: TELNET_WILL, Him: TELNET_DONT},
+			{TelOpt: TELOPT_SGA, Us: TELNET_WILL, Him: TELNET_DO},
+			{TelOpt: TELOPT_TTYPE, Us: TELNET_WONT, Him: TELNET_DO},
+			{TelOpt: TELOPT_NAWS, Us: TELNET_WONT, Him: TELNET_DO},
+		},
+		OnConnect: func(conn *Conn) {
+			conn.OnEvent = func(tl *Telnet, telnetEvent TelnetEventInterface) {
+				switch ev := telnetEvent.(type) {
+				case *TelnetNegotiateEvent:
+					if ev.EventType() == TELNET_EV_WILL && ev.TelOpt == TELOPT_TTYPE {
+						tl.TelnetTTypeSend()
+					}
+				case *TelnetNawsEvent:
+					subnegotiations <- [2]uint16{ev.Width, ev.Height}
+				case *TelnetTTypeEvent:
+					subnegotiations <- ev.Name
+				}
+			}
+		},
+		Handler: func(ctx context.Context, conn *Conn) {
+			io.Copy(io.Discard, conn)
+		},
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client, err := Dial(ctx, l.Addr().String(), &ClientConfig{
+		Options: []TelnetOptionReq{
+			{TelOpt: TELOPT_ECHO, Us: TELNET_WONT, Him: TELNET_DO},
+			{TelOpt: TELOPT_SGA, Us: TELNET_WILL, Him: TELNET_DO},
+		},
+		// TTYPE and NAWS are offered because of these settings
+		TerminalTypes: []string{"xterm-256color"},
+		Width:         120,
+		Height:        40,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// client reads to answer TTYPE requests
+	go io.Copy(io.Discard, client)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-subnegotiations:
+			switch v := v.(type) {
+			case [2]uint16:
+				if v != [2]uint16{120, 40} {
+					t.Errorf("Unexpected window size %v", v)
+				}
+			case string:
+				if v != "xterm-256color" {
+					t.Errorf("Unexpected terminal type %q", v)
+				}
+			}
+		case <-ctx.Done():
+			t.Fatal("Subnegotiation was not received")
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// server never answers
+	go func() {
+		nc, err := l.Accept()
+		if err == nil {
+			io.Copy(io.Discard, nc)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = Dial(ctx, l.Addr().String(), &ClientConfig{
+		Options: []TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WONT, Him: TELNET_DO}},
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Dial returned %v", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server := NewConn(serverSide, nil, nil)
+	client := NewConn(clientSide, nil, nil)
+	defer server.Close()
+	defer client.Close()
+	client.Do(func(tl *Telnet) {
+		tl.AYTResponse = "[yes]"
+	})
+
+	// client answers keepalives while reading
+	go io.Copy(io.Discard, client)
+
+	// answered keepalives keep the connection open
+	server.Keepalive(50*time.Millisecond, TELNET_AYT)
+	rsvData := make([]byte, 25)
+	if _, err := io.ReadFull(server, rsvData); err != nil {
+		t.Fatal(err)
+	}
+	if string(rsvData) != strings.Repeat("[yes]", 5) {
+		t.Errorf("Unexpected keepalive replies %q", rsvData)
+	}
+}
+
+func TestKeepaliveSilentPeer(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server := NewConn(serverSide, nil, nil)
+	defer server.Close()
+
+	// peer accepts data but never answers, so writes keep succeeding
+	go io.Copy(io.Discard, clientSide)
+	defer clientSide.Close()
+
+	server.Keepalive(10*time.Millisecond, TELNET_AYT)
+	readDone := make(chan error)
+	go func() {
+		_, err := io.Copy(io.Discard, server)
+		readDone <- err
+	}()
+	select {
+	case <-readDone:
+	case <-time.After(2 * time.Second):
+		t.Error("Connection to silent peer was not closed")
+	}
+}
+
+func TestServerShutdownNegotiating(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connected := make(chan struct{})
+	handled := make(chan struct{}, 1)
+	server := &Server{
+		Options:            []TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WILL}},
+		NegotiationTimeout: time.Minute,
+		OnConnect: func(conn *Conn) {
+			close(connected)
+		},
+		Handler: func(ctx context.Context, conn *Conn) {
+			handled <- struct{}{}
+		},
+	}
+	go server.Serve(l)
+
+	// silent client keeps the server negotiating
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	<-connected
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handled:
+		t.Error("Handler was started after Shutdown")
+	default:
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// Listener failing the first Accept calls with a temporary error
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handled := make(chan struct{}, 1)
+	server := &Server{
+		Handler: func(ctx context.Context, conn *Conn) {
+			handled <- struct{}{}
+		},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(&flakyListener{Listener: l, failures: 3})
+	}()
+	defer server.Close()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	select {
+	case <-handled:
+	case err := <-served:
+		t.Fatalf("Serve returned %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection was not served")
+	}
+}
+
+func TestConnCommands(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server := NewConn(serverSide, nil, nil)
+	client := NewConn(clientSide, nil, nil)
+	defer server.Close()
+	defer client.Close()
+
+	interrupted := make(chan bool, 1)
+	server.OnEvent = func(tl *Telnet, telnetEvent TelnetEventInterface) {
+		if ie, ok := telnetEvent.(*TelnetIacEvent); ok {
+			interrupted <- ie.IsInterrupt() && !ie.IsAreYouThere()
+		}
+	}
+	go io.Copy(io.Discard, server)
+
+	if err := client.InterruptProcess(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ok := <-interrupted:
+		if !ok {
+			t.Error("Interrupt Process was not recognized")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Command was not received")
+	}
+}
+
+func TestNegotiateTimingMark(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	server := NewConn(serverSide, []TelnetOptionReq{
+		{TelOpt: TELOPT_TM, Us: TELNET_WILL},
+		{TelOpt: TELOPT_ECHO, Us: TELNET_WILL},
+	}, nil)
+	client := NewConn(clientSide, []TelnetOptionReq{{TelOpt: TELOPT_ECHO, Him: TELNET_DO}}, nil)
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Negotiate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if state := server.OptionState(TELOPT_TM); state.Us() != Q_NO || state.Him() != Q_NO {
+		t.Errorf("Unexpected TIMING-MARK state %v/%v", state.Us(), state.Him())
+	}
+	if !server.LocalEnabled(TELOPT_ECHO) {
+		t.Error("ECHO was not negotiated")
+	}
+}
@@ -1,5 +1,7 @@
 package pactelnet
 
+import "time"
+
 type (
 	TelnetEventInterface interface {
 		EventType() TelnetEventType
@@ -30,7 +32,7 @@ type (
 	// Command event: for IAC
 	TelnetIacEvent struct {
 		telnetEvent
-		// Telnet command received
+		// Telnet command received: TELNET_IP, TELNET_AYT, TELNET_GA etc.
 		Cmd TelnetCommands
 	}
 
@@ -51,6 +53,90 @@ type (
 		// Option code for negotiation
 		TelOpt TelnetOptions
 	}
+
+	// Compression event: for COMPRESS
+	TelnetCompressEvent struct {
+		telnetEvent
+		// Option used for compression: TELOPT_COMPRESS2 or TELOPT_MCCP3
+		TelOpt TelnetOptions
+		// true for compression of sent data, false for received data
+		Outbound bool
+		// true if compression was enabled, false if it was disabled
+		State bool
+	}
+
+	// ZMP event: for ZMP
+	TelnetZmpEvent struct {
+		telnetEvent
+		// Command name followed by its arguments
+		Argv []string
+	}
+
+	// Terminal type event: for TTYPE
+	TelnetTTypeEvent struct {
+		telnetEvent
+		// TELNET_TTYPE_IS or TELNET_TTYPE_SEND
+		Cmd TelnetTType
+		// Terminal type name, empty for TELNET_TTYPE_SEND
+		Name string
+	}
+
+	// Environment event: for ENVIRON
+	TelnetEnvironEvent struct {
+		telnetEvent
+		// TELOPT_NEW_ENVIRON or TELOPT_OLD_ENVIRON
+		TelOpt TelnetOptions
+		// TELNET_ENVIRON_IS, TELNET_ENVIRON_SEND or TELNET_ENVIRON_INFO
+		Cmd TelnetEnviron
+		// Variables in order of appearance
+		Values []TelnetEnvironValue
+	}
+
+	// MSSP event: for MSSP
+	TelnetMsspEvent struct {
+		telnetEvent
+		// Variables in order of appearance
+		Values []MSSPPair
+	}
+
+	// Error event: for WARNING and ERROR
+	TelnetErrorEvent struct {
+		telnetEvent
+		// Error code
+		Code TelnetErrorCode
+		// true for non-recoverable errors
+		Fatal bool
+		// Error description
+		Message string
+	}
+
+	// Status event: for STATUS
+	TelnetStatusEvent struct {
+		telnetEvent
+		// TELNET_STATUS_IS or TELNET_STATUS_SEND
+		Cmd TelnetStatus
+		// Options the peer performs (WILL), empty for TELNET_STATUS_SEND
+		Will []TelnetOptions
+		// Options the peer expects us to perform (DO), empty for TELNET_STATUS_SEND
+		Do []TelnetOptions
+	}
+
+	// Window size event: for NAWS
+	TelnetNawsEvent struct {
+		telnetEvent
+		// Width and height in characters; zero if unknown
+		Width  uint16
+		Height uint16
+	}
+
+	// Timing mark event: for TIMING_MARK
+	TelnetTimingMarkEvent struct {
+		telnetEvent
+		// true if the peer answered WILL, false for WONT
+		Accepted bool
+		// Time between sending DO TIMING-MARK and receiving the reply
+		RTT time.Duration
+	}
 )
 
 func (te *telnetEvent) EventType() TelnetEventType {
@@ -83,6 +169,56 @@ func NewTelnetIacEvent() *TelnetIacEvent {
 	return ie
 }
 
+// Interrupt Process (IP) received
+func (ie *TelnetIacEvent) IsInterrupt() bool {
+	return ie.Cmd == TELNET_IP
+}
+
+// Abort Output (AO) received
+func (ie *TelnetIacEvent) IsAbortOutput() bool {
+	return ie.Cmd == TELNET_AO
+}
+
+// Are You There (AYT) received
+func (ie *TelnetIacEvent) IsAreYouThere() bool {
+	return ie.Cmd == TELNET_AYT
+}
+
+// Erase Character (EC) received
+func (ie *TelnetIacEvent) IsEraseCharacter() bool {
+	return ie.Cmd == TELNET_EC
+}
+
+// Erase Line (EL) received
+func (ie *TelnetIacEvent) IsEraseLine() bool {
+	return ie.Cmd == TELNET_EL
+}
+
+// NVT Break (BRK) received
+func (ie *TelnetIacEvent) IsBreak() bool {
+	return ie.Cmd == TELNET_BRK
+}
+
+// Go Ahead (GA) received
+func (ie *TelnetIacEvent) IsGoAhead() bool {
+	return ie.Cmd == TELNET_GA
+}
+
+// No Operation (NOP) received
+func (ie *TelnetIacEvent) IsNoOperation() bool {
+	return ie.Cmd == TELNET_NOP
+}
+
+// End of Record (EOR) received
+func (ie *TelnetIacEvent) IsEndOfRecord() bool {
+	return ie.Cmd == TELNET_EOR
+}
+
+// Data Mark (DM) of a Synch received
+func (ie *TelnetIacEvent) IsDataMark() bool {
+	return ie.Cmd == TELNET_DM
+}
+
 func NewTelnetNegotiateEvent(eventType TelnetEventType) *TelnetNegotiateEvent {
 	ne := &TelnetNegotiateEvent{}
 	ne.eventType = eventType
@@ -94,3 +230,130 @@ func NewTelnetSubnegotiateEvent() *TelnetSubnegotiateEvent {
 	se.eventType = TELNET_EV_SUBNEGOTIATION
 	return se
 }
+
+func NewTelnetCompressEvent() *TelnetCompressEvent {
+	ce := &TelnetCompressEvent{}
+	ce.eventType = TELNET_EV_COMPRESS
+	return ce
+}
+
+func NewTelnetZmpEvent() *TelnetZmpEvent {
+	ze := &TelnetZmpEvent{}
+	ze.eventType = TELNET_EV_ZMP
+	return ze
+}
+
+func NewTelnetTTypeEvent() *TelnetTTypeEvent {
+	te := &TelnetTTypeEvent{}
+	te.eventType = TELNET_EV_TTYPE
+	return te
+}
+
+func NewTelnetEnvironEvent() *TelnetEnvironEvent {
+	ee := &TelnetEnvironEvent{}
+	ee.eventType = TELNET_EV_ENVIRON
+	return ee
+}
+
+func NewTelnetMsspEvent() *TelnetMsspEvent {
+	me := &TelnetMsspEvent{}
+	me.eventType = TELNET_EV_MSSP
+	return me
+}
+
+func NewTelnetStatusEvent() *TelnetStatusEvent {
+	se := &TelnetStatusEvent{}
+	se.eventType = TELNET_EV_STATUS
+	return se
+}
+
+func NewTelnetNawsEvent() *TelnetNawsEvent {
+	ne := &TelnetNawsEvent{}
+	ne.eventType = TELNET_EV_NAWS
+	return ne
+}
+
+func NewTelnetTimingMarkEvent() *TelnetTimingMarkEvent {
+	te := &TelnetTimingMarkEvent{}
+	te.eventType = TELNET_EV_TIMING_MARK
+	return te
+}
+
+func NewTelnetErrorEvent(fatal bool) *TelnetErrorEvent {
+	ee := &TelnetErrorEvent{Fatal: fatal}
+	ee.eventType = TELNET_EV_WARNING
+	if fatal {
+		ee.eventType = TELNET_EV_ERROR
+	}
+	return ee
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Events and buffers reused for every event of the same kind when
+// Telnet.ReuseEvents is set
+type eventCache struct {
+	send      TelnetSendEvent
+	data      TelnetDataEvent
+	iac       TelnetIacEvent
+	negotiate TelnetNegotiateEvent
+	dataByte  [1]byte
+	command   [3]byte
+}
+
+func (tl *Telnet) newSendEvent() *TelnetSendEvent {
+	if !tl.ReuseEvents {
+		return NewTelnetSendEvent()
+	}
+	se := &tl.events.send
+	*se = TelnetSendEvent{}
+	se.eventType = TELNET_EV_SEND
+	return se
+}
+
+func (tl *Telnet) newDataEvent() *TelnetDataEvent {
+	if !tl.ReuseEvents {
+		return NewTelnetDataEvent()
+	}
+	de := &tl.events.data
+	*de = TelnetDataEvent{}
+	de.eventType = TELNET_EV_DATA
+	return de
+}
+
+func (tl *Telnet) newIacEvent() *TelnetIacEvent {
+	if !tl.ReuseEvents {
+		return NewTelnetIacEvent()
+	}
+	ie := &tl.events.iac
+	*ie = TelnetIacEvent{}
+	ie.eventType = TELNET_EV_IAC
+	return ie
+}
+
+func (tl *Telnet) newNegotiateEvent(eventType TelnetEventType) *TelnetNegotiateEvent {
+	if !tl.ReuseEvents {
+		return NewTelnetNegotiateEvent(eventType)
+	}
+	ne := &tl.events.negotiate
+	*ne = TelnetNegotiateEvent{}
+	ne.eventType = eventType
+	return ne
+}
+
+// Buffer holding a single received byte
+func (tl *Telnet) byteBuffer(b byte) []byte {
+	if !tl.ReuseEvents {
+		return []byte{b}
+	}
+	tl.events.dataByte[0] = b
+	return tl.events.dataByte[:]
+}
+
+// Buffer for a command of up to 3 bytes to be sent
+func (tl *Telnet) commandBuffer(size int) []byte {
+	if !tl.ReuseEvents {
+		return make([]byte, size)
+	}
+	return tl.events.command[:size]
+}
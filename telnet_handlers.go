@@ -0,0 +1,70 @@
+package pactelnet
+
+// Implementation of a telnet option, see Telnet.RegisterOption
+type OptionHandler interface {
+	// Check if we agree to perform the option when the peer asks (DO)
+	AcceptLocal(tl *Telnet) bool
+	// Check if we agree the peer performs the option when it offers (WILL)
+	AcceptRemote(tl *Telnet) bool
+	// Option is enabled on our side
+	OnLocalEnable(tl *Telnet)
+	// Option is enabled on the peer side
+	OnRemoteEnable(tl *Telnet)
+	// Option is disabled on our side (local is true) or on the peer side
+	OnDisable(tl *Telnet, local bool)
+	// Subnegotiation of the option is received; buffer is valid only
+	// during the call
+	OnSubnegotiation(tl *Telnet, buffer []byte)
+}
+
+// Handler refusing the option on both sides and ignoring all hooks;
+// embed it to implement only the hooks needed
+type BaseOptionHandler struct{}
+
+func (BaseOptionHandler) AcceptLocal(tl *Telnet) bool                { return false }
+func (BaseOptionHandler) AcceptRemote(tl *Telnet) bool               { return false }
+func (BaseOptionHandler) OnLocalEnable(tl *Telnet)                   {}
+func (BaseOptionHandler) OnRemoteEnable(tl *Telnet)                  {}
+func (BaseOptionHandler) OnDisable(tl *Telnet, local bool)           {}
+func (BaseOptionHandler) OnSubnegotiation(tl *Telnet, buffer []byte) {}
+
+//------------------------------------------------------------------------------------------------//
+
+// Register handler of the option; it replaces the option table entry in
+// deciding whether the option is accepted. nil handler unregisters.
+func (tl *Telnet) RegisterOption(telopt byte, handler OptionHandler) {
+	if handler == nil {
+		delete(tl.handlers, telopt)
+		return
+	}
+	if tl.handlers == nil {
+		tl.handlers = make(map[byte]OptionHandler)
+	}
+	tl.handlers[telopt] = handler
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Act on option state transitions; q is the state before negotiation
+func (tl *Telnet) optionChanged(telopt byte, q TelnetRFC1143) {
+	now := tl.getRFC1143(telopt)
+	handler := tl.handlers[telopt]
+
+	if q_US(q) != byte(Q_YES) && q_US(now) == byte(Q_YES) {
+		tl.localEnabled(telopt)
+		if handler != nil {
+			handler.OnLocalEnable(tl)
+		}
+	} else if q_US(q) == byte(Q_YES) && q_US(now) != byte(Q_YES) && handler != nil {
+		handler.OnDisable(tl, true)
+	}
+
+	if handler == nil {
+		return
+	}
+	if q_HIM(q) != byte(Q_YES) && q_HIM(now) == byte(Q_YES) {
+		handler.OnRemoteEnable(tl)
+	} else if q_HIM(q) == byte(Q_YES) && q_HIM(now) != byte(Q_YES) {
+		handler.OnDisable(tl, false)
+	}
+}
@@ -1,10 +1,15 @@
 package pactelnet
 
+import "fmt"
+
 type (
+	// Error code reported with WARNING and ERROR events
+	TelnetErrorCode byte
+	// RFC1143 Q-method state of one side of an option
+	TelnetRFC1143State byte
+
 	telnetInternalFlags byte
 	telnetState         byte
-	telnetErrorCode     byte
-	rfc1143StateNames   byte
 
 	// RFC1143 option negotiation state
 	TelnetRFC1143 struct {
@@ -37,26 +42,73 @@ const (
 
 /// Error codes
 const (
-	TELNET_EOK       telnetErrorCode = 0 /*!< no error */
-	TELNET_EBADVAL                       /*!< invalid parameter, or API misuse */
-	TELNET_ENOMEM                        /*!< memory allocation failure */
-	TELNET_EOVERFLOW                     /*!< data exceeds buffer size */
-	TELNET_EPROTOCOL                     /*!< invalid sequence of special bytes */
-	TELNET_ECOMPRESS                     /*!< error handling compressed streams */
+	TELNET_EOK       TelnetErrorCode = iota /*!< no error */
+	TELNET_EBADVAL                          /*!< invalid parameter, or API misuse */
+	TELNET_ENOMEM                           /*!< memory allocation failure */
+	TELNET_EOVERFLOW                        /*!< data exceeds buffer size */
+	TELNET_EPROTOCOL                        /*!< invalid sequence of special bytes */
+	TELNET_ECOMPRESS                        /*!< error handling compressed streams */
 )
 
+var errorMessages = [...]string{
+	TELNET_EOK:       "no error",
+	TELNET_EBADVAL:   "invalid parameter, or API misuse",
+	TELNET_ENOMEM:    "memory allocation failure",
+	TELNET_EOVERFLOW: "data exceeds buffer size",
+	TELNET_EPROTOCOL: "invalid sequence of special bytes",
+	TELNET_ECOMPRESS: "error handling compressed streams",
+}
+
+func (code TelnetErrorCode) Error() string {
+	if int(code) < len(errorMessages) {
+		return errorMessages[code]
+	}
+	return fmt.Sprintf("telnet error %d", code)
+}
+
 /// <summary>
 /// RFC1143 state names
 /// </summary>
 const (
-	Q_NO         rfc1143StateNames = 0
-	Q_YES                          = 1
-	Q_WANTNO                       = 2
-	Q_WANTYES                      = 3
-	Q_WANTNO_OP                    = 4
-	Q_WANTYES_OP                   = 5
+	Q_NO         TelnetRFC1143State = 0
+	Q_YES                           = 1
+	Q_WANTNO                        = 2
+	Q_WANTYES                       = 3
+	Q_WANTNO_OP                     = 4
+	Q_WANTYES_OP                    = 5
 )
 
+var stateNames = [...]string{
+	Q_NO:         "NO",
+	Q_YES:        "YES",
+	Q_WANTNO:     "WANTNO",
+	Q_WANTYES:    "WANTYES",
+	Q_WANTNO_OP:  "WANTNO_OP",
+	Q_WANTYES_OP: "WANTYES_OP",
+}
+
+func (state TelnetRFC1143State) String() string {
+	if int(state) < len(stateNames) {
+		return stateNames[state]
+	}
+	return fmt.Sprintf("TelnetRFC1143State(%d)", state)
+}
+
+// Option code
+func (q TelnetRFC1143) TelOpt() TelnetOptions {
+	return TelnetOptions(q.telopt)
+}
+
+// State of the option on our side
+func (q TelnetRFC1143) Us() TelnetRFC1143State {
+	return TelnetRFC1143State(q_US(q))
+}
+
+// State of the option on the peer side
+func (q TelnetRFC1143) Him() TelnetRFC1143State {
+	return TelnetRFC1143State(q_HIM(q))
+}
+
 /* helper for Q-method option tracking */
 func q_US(q TelnetRFC1143) byte {
 	return (byte)(q.state & 0x0F)
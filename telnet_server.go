@@ -0,0 +1,248 @@
+package pactelnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Telnet server: accepts connections, negotiates options from the
+// option table and passes ready connections to Handler.
+type Server struct {
+	// Options offered to every client
+	Options []TelnetOptionReq
+	// Flags of every client state tracker
+	Flags []TelnetFlags
+	// Time to wait for replies to the initial offers,
+	// DefaultNegotiationTimeout if zero. Clients that do not answer in
+	// time are passed to Handler anyway.
+	NegotiationTimeout time.Duration
+	// Interval of IAC NOP keepalives sent to every client once the
+	// initial negotiation is over; zero disables keepalives
+	Keepalive time.Duration
+	// Called before the initial offers are sent, e.g. to set Conn.OnEvent
+	OnConnect func(conn *Conn)
+	// Called in its own goroutine for every client; ctx is cancelled
+	// when Shutdown is called. Connection is closed when Handler returns.
+	Handler func(ctx context.Context, conn *Conn)
+
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	conns      map[*Conn]struct{}
+	inShutdown bool
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+// Default time to wait for replies to the initial offers
+const DefaultNegotiationTimeout = 5 * time.Second
+
+// Longest wait before accepting again after a temporary error
+const maxAcceptDelay = time.Second
+
+// Returned by Serve after Shutdown or Close
+var ErrServerClosed = errors.New("pactelnet: Server closed")
+
+//------------------------------------------------------------------------------------------------//
+
+// Listen on the TCP network address and serve clients
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Accept connections on the listener and serve them. Temporary accept
+// errors are retried with backoff. Always returns a non-nil error;
+// after Shutdown or Close it is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var tempDelay time.Duration // how long to sleep on accept failure
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				select {
+				case <-time.After(tempDelay):
+				case <-s.baseContext().Done():
+				}
+				continue
+			}
+			return err
+		}
+		tempDelay = 0
+
+		s.mu.Lock()
+		if s.inShutdown {
+			s.mu.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(nc)
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Gracefully shut down the server: listeners are closed, handler
+// contexts are cancelled and running sessions are waited for. If ctx
+// is done first, remaining connections are closed and ctx error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.close()
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.closeConns()
+		return ctx.Err()
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Immediately close all listeners and connections
+func (s *Server) Close() error {
+	s.close()
+	s.closeConns()
+	return nil
+}
+
+//------------------------------------------------------------------------------------------------//
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer s.wg.Done()
+
+	conn := NewConn(nc, s.Options, s.Flags)
+	defer conn.Close()
+	s.trackConn(conn, true)
+	defer s.trackConn(conn, false)
+
+	if s.OnConnect != nil {
+		s.OnConnect(conn)
+	}
+
+	timeout := s.NegotiationTimeout
+	if timeout == 0 {
+		timeout = DefaultNegotiationTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.baseContext(), timeout)
+	err := conn.Negotiate(ctx)
+	cancel()
+	// silent clients are served anyway, broken ones are not
+	if err != nil && ctx.Err() == nil {
+		return
+	}
+	// negotiation was interrupted by Shutdown
+	if s.shuttingDown() {
+		return
+	}
+
+	if s.Keepalive > 0 {
+		conn.Keepalive(s.Keepalive, TELNET_NOP)
+	}
+	if s.Handler != nil {
+		s.Handler(s.baseContext(), conn)
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Context of handlers, cancelled on shutdown
+func (s *Server) baseContext() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+// Stop accepting connections and cancel handler contexts
+func (s *Server) close() {
+	s.baseContext()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown = true
+	s.cancel()
+	for l := range s.listeners {
+		l.Close()
+	}
+}
+
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if s.inShutdown {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(c *Conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*Conn]struct{})
+	}
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
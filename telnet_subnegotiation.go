@@ -0,0 +1,423 @@
+package pactelnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+)
+
+// Send a ZMP command: command name followed by its arguments.
+// Arguments must not contain NUL bytes.
+func (tl *Telnet) TelnetSendZmp(argv ...string) {
+	var buffer bytes.Buffer
+	for _, arg := range argv {
+		buffer.WriteString(arg)
+		buffer.WriteByte(0)
+	}
+	tl.TelnetSubnegotiation(TELOPT_ZMP, buffer.Bytes())
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Request the terminal type from the peer (TERMINAL-TYPE SEND)
+func (tl *Telnet) TelnetTTypeSend() {
+	tl.TelnetSubnegotiation(TELOPT_TTYPE, []byte{byte(TELNET_TTYPE_SEND)})
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Report our terminal type to the peer (TERMINAL-TYPE IS)
+func (tl *Telnet) TelnetTTypeIs(name string) {
+	buffer := make([]byte, 0, len(name)+1)
+	buffer = append(buffer, byte(TELNET_TTYPE_IS))
+	buffer = append(buffer, name...)
+	tl.TelnetSubnegotiation(TELOPT_TTYPE, buffer)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Report our window size to the peer (NAWS); zero means unknown
+func (tl *Telnet) TelnetSendNaws(width, height uint16) {
+	var size [4]byte
+	binary.BigEndian.PutUint16(size[0:], width)
+	binary.BigEndian.PutUint16(size[2:], height)
+	tl.TelnetSubnegotiation(TELOPT_NAWS, size[:])
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Request the option status from the peer (STATUS SEND)
+func (tl *Telnet) TelnetStatusSend() {
+	tl.TelnetSubnegotiation(TELOPT_STATUS, []byte{byte(TELNET_STATUS_SEND)})
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Report options enabled on each side to the peer (STATUS IS): WILL
+// for options we perform, DO for options the peer performs
+func (tl *Telnet) TelnetStatusIs() {
+	buffer := []byte{byte(TELNET_STATUS_IS)}
+	for i := range tl.rfc1143 {
+		q := tl.getRFC1143(byte(i))
+		if q_US(q) == byte(Q_YES) {
+			buffer = appendStatusOption(buffer, TELNET_WILL, byte(i))
+		}
+		if q_HIM(q) == byte(Q_YES) {
+			buffer = appendStatusOption(buffer, TELNET_DO, byte(i))
+		}
+	}
+	tl.TelnetSubnegotiation(TELOPT_STATUS, buffer)
+}
+
+// SE option code is doubled inside STATUS IS, as RFC 859 requires
+func appendStatusOption(buffer []byte, cmd TelnetCommands, telopt byte) []byte {
+	buffer = append(buffer, byte(cmd), telopt)
+	if telopt == byte(TELNET_SE) {
+		buffer = append(buffer, telopt)
+	}
+	return buffer
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Send a NEW-ENVIRON command. For TELNET_ENVIRON_SEND only types and
+// names are sent (empty list requests all variables); for
+// TELNET_ENVIRON_IS and TELNET_ENVIRON_INFO values are sent as well,
+// except for variables marked Undefined.
+func (tl *Telnet) TelnetSendEnviron(cmd TelnetEnviron, values []TelnetEnvironValue) {
+	buffer := []byte{byte(cmd)}
+	for _, v := range values {
+		buffer = append(buffer, byte(v.Type))
+		buffer = appendEnvironString(buffer, v.Name)
+		if cmd != TELNET_ENVIRON_SEND && !v.Undefined {
+			buffer = append(buffer, byte(TELNET_ENVIRON_VALUE))
+			buffer = appendEnvironString(buffer, v.Value)
+		}
+	}
+	tl.TelnetSubnegotiation(TELOPT_NEW_ENVIRON, buffer)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Send MSSP variables, see MSSPEncode
+func (tl *Telnet) TelnetSendMSSP(table map[string][]string) {
+	tl.TelnetSubnegotiation(TELOPT_MSSP, MSSPEncode(table))
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Build MSSP subnegotiation data: every variable is followed by all of
+// its values.  Variables are sorted by name, so the result is stable.
+// Names and values must not contain MSSP_VAR and MSSP_VAL bytes.
+func MSSPEncode(table map[string][]string) []byte {
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	for _, name := range names {
+		buffer.WriteByte(byte(MSSP_VAR))
+		buffer.WriteString(name)
+		for _, value := range table[name] {
+			buffer.WriteByte(byte(MSSP_VAL))
+			buffer.WriteString(value)
+		}
+	}
+	return buffer.Bytes()
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Parse ZMP command subnegotiation buffers
+func (tl *Telnet) zmpTelnet(buffer []byte) {
+	// make sure this is a valid ZMP buffer
+	if len(buffer) == 0 || buffer[len(buffer)-1] != 0 {
+		tl.raiseError(TELNET_EPROTOCOL, false, "incomplete ZMP frame")
+		return
+	}
+
+	// split NUL-terminated arguments
+	argv := strings.Split(string(buffer[:len(buffer)-1]), "\x00")
+	if argv[0] == "" {
+		tl.raiseError(TELNET_EPROTOCOL, false, "ZMP frame has empty command")
+		return
+	}
+
+	ze := NewTelnetZmpEvent()
+	ze.Argv = argv
+	tl.callEventHandler(ze)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Parse TERMINAL-TYPE command subnegotiation buffers
+func (tl *Telnet) ttypeTelnet(buffer []byte) {
+	// make sure request is not empty
+	if len(buffer) == 0 {
+		tl.raiseError(TELNET_EPROTOCOL, false, "incomplete TERMINAL-TYPE request")
+		return
+	}
+
+	// make sure request has valid command type
+	if buffer[0] != byte(TELNET_TTYPE_IS) && buffer[0] != byte(TELNET_TTYPE_SEND) {
+		tl.raiseError(TELNET_EPROTOCOL, false, "TERMINAL-TYPE request has invalid type")
+		return
+	}
+
+	te := NewTelnetTTypeEvent()
+	te.Cmd = TelnetTType(buffer[0])
+	if te.Cmd == TELNET_TTYPE_IS {
+		te.Name = string(buffer[1:])
+	}
+	tl.callEventHandler(te)
+
+	if te.Cmd == TELNET_TTYPE_SEND {
+		tl.ttypeReply()
+	}
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Answer TERMINAL-TYPE SEND from the TerminalTypes list if we perform
+// the option. As RFC 1091 requires, the last type is repeated to mark
+// the end of the list, and the next request starts over from the
+// first one.
+func (tl *Telnet) ttypeReply() {
+	if len(tl.TerminalTypes) == 0 || tl.flags.Contains(int(TELNET_FLAG_PROXY)) {
+		return
+	}
+	if q_US(tl.getRFC1143(byte(TELOPT_TTYPE))) != byte(Q_YES) {
+		return
+	}
+
+	name := tl.TerminalTypes[len(tl.TerminalTypes)-1]
+	if tl.ttypeIndex < len(tl.TerminalTypes) {
+		name = tl.TerminalTypes[tl.ttypeIndex]
+		tl.ttypeIndex++
+	} else {
+		tl.ttypeIndex = 0
+	}
+	tl.TelnetTTypeIs(name)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Parse NAWS subnegotiation buffers; doubled IAC bytes are already
+// unescaped by the parser
+func (tl *Telnet) nawsTelnet(buffer []byte) {
+	if len(buffer) != 4 {
+		tl.raiseError(TELNET_EPROTOCOL, false, "NAWS subnegotiation has invalid size %d", len(buffer))
+		return
+	}
+
+	ne := NewTelnetNawsEvent()
+	ne.Width = binary.BigEndian.Uint16(buffer[0:])
+	ne.Height = binary.BigEndian.Uint16(buffer[2:])
+	tl.callEventHandler(ne)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Parse STATUS subnegotiation buffers; SEND is answered with our
+// status if we perform the option
+func (tl *Telnet) statusTelnet(buffer []byte) {
+	// make sure request has valid command type
+	if len(buffer) == 0 || (buffer[0] != byte(TELNET_STATUS_IS) && buffer[0] != byte(TELNET_STATUS_SEND)) {
+		tl.raiseError(TELNET_EPROTOCOL, false, "STATUS request has invalid type")
+		return
+	}
+
+	se := NewTelnetStatusEvent()
+	se.Cmd = TelnetStatus(buffer[0])
+	if se.Cmd == TELNET_STATUS_IS {
+		if !parseStatus(se, buffer[1:]) {
+			tl.raiseError(TELNET_EPROTOCOL, false, "malformed STATUS IS")
+			return
+		}
+	}
+	tl.callEventHandler(se)
+
+	if se.Cmd == TELNET_STATUS_SEND && !tl.flags.Contains(int(TELNET_FLAG_PROXY)) && q_US(tl.getRFC1143(byte(TELOPT_STATUS))) == byte(Q_YES) {
+		tl.TelnetStatusIs()
+	}
+}
+
+// Collect WILL and DO options of STATUS IS; subnegotiation states
+// (SB option ... SE) are skipped
+func parseStatus(se *TelnetStatusEvent, data []byte) bool {
+	for i := 0; i < len(data); i++ {
+		cmd := data[i]
+		if cmd == byte(TELNET_SB) {
+			// find the SE not doubled
+			for i++; i < len(data); i++ {
+				if data[i] == byte(TELNET_SE) {
+					if i+1 >= len(data) || data[i+1] != byte(TELNET_SE) {
+						break
+					}
+					i++
+				}
+			}
+			continue
+		}
+
+		if i+1 >= len(data) {
+			return false
+		}
+		i++
+		telopt := data[i]
+		if telopt == byte(TELNET_SE) {
+			if i+1 >= len(data) || data[i+1] != byte(TELNET_SE) {
+				return false
+			}
+			i++
+		}
+
+		switch cmd {
+		case byte(TELNET_WILL):
+			se.Will = append(se.Will, TelnetOptions(telopt))
+		case byte(TELNET_DO):
+			se.Do = append(se.Do, TelnetOptions(telopt))
+		case byte(TELNET_WONT), byte(TELNET_DONT):
+			// disabled options are normally not listed at all
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Parse NEW-ENVIRON and OLD-ENVIRON subnegotiation buffers
+func (tl *Telnet) environTelnet(telopt byte, buffer []byte) {
+	// if we have no data, just pass it through
+	if len(buffer) == 0 {
+		return
+	}
+
+	// first byte must be a valid command
+	if buffer[0] != byte(TELNET_ENVIRON_IS) && buffer[0] != byte(TELNET_ENVIRON_SEND) && buffer[0] != byte(TELNET_ENVIRON_INFO) {
+		tl.raiseError(TELNET_EPROTOCOL, false, "telopt %d subneg has invalid command", telopt)
+		return
+	}
+
+	ee := NewTelnetEnvironEvent()
+	ee.TelOpt = TelnetOptions(telopt)
+	ee.Cmd = TelnetEnviron(buffer[0])
+
+	data := buffer[1:]
+	if len(data) != 0 {
+		varType, valueType := byte(TELNET_ENVIRON_VAR), byte(TELNET_ENVIRON_VALUE)
+		if telopt == TELOPT_OLD_ENVIRON && data[0] == byte(TELNET_ENVIRON_VALUE) {
+			/* RFC 1571: BSD derived OLD-ENVIRON implementations swapped the
+			 * VAR and VALUE codes of RFC 1408.  A list can't start with a
+			 * VALUE, so seeing one first tells us the peer uses swapped codes.
+			 */
+			varType, valueType = valueType, varType
+		}
+
+		// ensure last byte is not an escape byte (makes parsing later easier)
+		if data[len(data)-1] == byte(TELNET_ENVIRON_ESC) {
+			tl.raiseError(TELNET_EPROTOCOL, false, "telopt %d subneg ends with ESC", telopt)
+			return
+		}
+
+		for i := 0; i < len(data); {
+			// each entry starts with VAR or USERVAR
+			var ev TelnetEnvironValue
+			switch data[i] {
+			case varType:
+				ev.Type = TELNET_ENVIRON_VAR
+			case byte(TELNET_ENVIRON_USERVAR):
+				ev.Type = TELNET_ENVIRON_USERVAR
+			default:
+				tl.raiseError(TELNET_EPROTOCOL, false, "telopt %d subneg missing variable type", telopt)
+				return
+			}
+
+			ev.Name, i = environString(data, i+1)
+			// value is optional; variable without one is undefined
+			if i < len(data) && data[i] == valueType {
+				ev.Value, i = environString(data, i+1)
+			} else {
+				ev.Undefined = true
+			}
+			ee.Values = append(ee.Values, ev)
+		}
+	}
+
+	tl.callEventHandler(ee)
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Append ENVIRON string to buffer escaping the type bytes
+func appendEnvironString(buffer []byte, str string) []byte {
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case byte(TELNET_ENVIRON_VAR), byte(TELNET_ENVIRON_VALUE), byte(TELNET_ENVIRON_ESC), byte(TELNET_ENVIRON_USERVAR):
+			buffer = append(buffer, byte(TELNET_ENVIRON_ESC))
+		}
+		buffer = append(buffer, str[i])
+	}
+	return buffer
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Unescape ENVIRON string starting at pos up to the next type byte;
+// returns the string and position of the type byte
+func environString(data []byte, pos int) (string, int) {
+	var out []byte
+	for ; pos < len(data); pos++ {
+		switch data[pos] {
+		case byte(TELNET_ENVIRON_VAR), byte(TELNET_ENVIRON_VALUE), byte(TELNET_ENVIRON_USERVAR):
+			return string(out), pos
+		case byte(TELNET_ENVIRON_ESC):
+			pos++
+		}
+		out = append(out, data[pos])
+	}
+	return string(out), pos
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Parse MSSP subnegotiation buffers
+func (tl *Telnet) msspTelnet(buffer []byte) {
+	// if we have no data, just pass it through
+	if len(buffer) == 0 {
+		return
+	}
+
+	// first byte must be a VAR
+	if buffer[0] != byte(MSSP_VAR) {
+		tl.raiseError(TELNET_EPROTOCOL, false, "MSSP subnegotiation has invalid data")
+		return
+	}
+
+	me := NewTelnetMsspEvent()
+	var pair *MSSPPair
+	for i := 0; i < len(buffer); {
+		code := buffer[i]
+		end := i + 1
+		for end < len(buffer) && buffer[end] != byte(MSSP_VAR) && buffer[end] != byte(MSSP_VAL) {
+			end++
+		}
+		str := string(buffer[i+1 : end])
+
+		// every VAR starts a new variable, VAL adds a value to it
+		if code == byte(MSSP_VAR) {
+			me.Values = append(me.Values, MSSPPair{Name: str})
+			pair = &me.Values[len(me.Values)-1]
+		} else {
+			pair.Values = append(pair.Values, str)
+		}
+		i = end
+	}
+
+	tl.callEventHandler(me)
+}
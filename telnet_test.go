@@ -1,6 +1,15 @@
 package pactelnet
 
-import "testing"
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestDataIAC(t *testing.T) {
 	var rsvData []byte
@@ -30,3 +39,1084 @@ func TestDataIAC(t *testing.T) {
 		t.Error("Data from telnet not equal with expected")
 	}
 }
+
+func TestNegotiateHimAccepted(t *testing.T) {
+	telnet := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_ECHO, Him: TELNET_DO}}, nil, nil)
+	sent := collectSend(telnet)
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_ECHO})
+
+	expected := []byte{TELNET_IAC, byte(TELNET_DO), TELOPT_ECHO}
+	if len(*sent) != 1 || !bytes.Equal((*sent)[0], expected) {
+		t.Errorf("Answer to WILL %v not equal with expected %v", *sent, expected)
+	}
+}
+
+func TestSubnegotiationRecv(t *testing.T) {
+	var rsvData []byte
+
+	telnet := NewTelnet(nil, nil, nil)
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		switch telnetEvent.EventType() {
+		case TELNET_EV_SUBNEGOTIATION:
+			rsvData = append([]byte(nil), telnetEvent.(*TelnetSubnegotiateEvent).Buffer...)
+		}
+	}
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_LINEMODE, 1, 2, TELNET_IAC, TELNET_IAC, 3, TELNET_IAC, byte(TELNET_SE)})
+
+	expected := []byte{1, 2, TELNET_IAC, 3}
+	if !bytes.Equal(rsvData, expected) {
+		t.Errorf("Subnegotiation data %v not equal with expected %v", rsvData, expected)
+	}
+}
+
+func collectSend(telnet *Telnet) *[][]byte {
+	sent := new([][]byte)
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_SEND {
+			sendEvent := telnetEvent.(*TelnetSendEvent)
+			*sent = append(*sent, append([]byte(nil), sendEvent.Buffer...))
+		}
+	}
+	return sent
+}
+
+func TestSendEscape(t *testing.T) {
+	telnet := NewTelnet(nil, nil, nil)
+	sent := collectSend(telnet)
+	telnet.TelnetSend([]byte{TELNET_IAC, 'a', 'b', TELNET_IAC})
+
+	var out []byte
+	for _, v := range *sent {
+		out = append(out, v...)
+	}
+	expected := []byte{TELNET_IAC, TELNET_IAC, 'a', 'b', TELNET_IAC, TELNET_IAC}
+	if !bytes.Equal(out, expected) {
+		t.Errorf("Escaped data %v not equal with expected %v", out, expected)
+	}
+}
+
+func TestSendTextEOL(t *testing.T) {
+	telnet := NewTelnet(nil, nil, nil)
+	sent := collectSend(telnet)
+
+	// NVT mode: EOL is translated
+	telnet.TelnetSendText([]byte("a\nb\r"))
+	if out := bytes.Join(*sent, nil); string(out) != "a\r\nb\r\x00" {
+		t.Errorf("Unexpected NVT text %q", out)
+	}
+
+	// binary mode: text is sent as is
+	*sent = nil
+	telnet.internalFlags.Add(int(TELNET_FLAG_TRANSMIT_BINARY))
+	telnet.TelnetSendText([]byte("a\nb\r"))
+	if out := bytes.Join(*sent, nil); string(out) != "a\nb\r" {
+		t.Errorf("Unexpected binary text %q", out)
+	}
+}
+
+func TestSubnegotiationSend(t *testing.T) {
+	telnet := NewTelnet(nil, nil, nil)
+	sent := collectSend(telnet)
+	telnet.TelnetSubnegotiation(TELOPT_NAWS, []byte{0, TELNET_IAC, 0, 24})
+
+	if len(*sent) != 1 {
+		t.Fatalf("Expected single send event, got %d", len(*sent))
+	}
+	expected := []byte{TELNET_IAC, byte(TELNET_SB), TELOPT_NAWS, 0, TELNET_IAC, TELNET_IAC, 0, 24, TELNET_IAC, byte(TELNET_SE)}
+	if !bytes.Equal((*sent)[0], expected) {
+		t.Errorf("Subnegotiation %v not equal with expected %v", (*sent)[0], expected)
+	}
+}
+
+func TestCompress2Recv(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("hello "))
+	zw.Flush()
+	zw.Write([]byte("compressed "))
+	zw.Close()
+
+	stream := []byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_COMPRESS2}
+	stream = append(stream, TELNET_IAC, byte(TELNET_SB), TELOPT_COMPRESS2, TELNET_IAC, byte(TELNET_SE))
+	stream = append(stream, compressed.Bytes()...)
+	stream = append(stream, "world"...)
+
+	// whole stream at once and byte by byte
+	for _, step := range []int{len(stream), 1} {
+		var rsvData []byte
+		var states []bool
+
+		telnet := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_COMPRESS2, Him: TELNET_DO}}, nil, nil)
+		telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+			switch telnetEvent.EventType() {
+			case TELNET_EV_DATA:
+				rsvData = append(rsvData, telnetEvent.(*TelnetDataEvent).Buffer...)
+			case TELNET_EV_COMPRESS:
+				states = append(states, telnetEvent.(*TelnetCompressEvent).State)
+			}
+		}
+		for i := 0; i < len(stream); i += step {
+			end := i + step
+			if end > len(stream) {
+				end = len(stream)
+			}
+			telnet.TelnetRecv(stream[i:end])
+		}
+		telnet.TelnetClose()
+
+		if string(rsvData) != "hello compressed world" {
+			t.Errorf("Inflated data %q not equal with expected", rsvData)
+		}
+		if len(states) != 2 || !states[0] || states[1] {
+			t.Errorf("Unexpected compression events %v", states)
+		}
+	}
+}
+
+func TestCompress2Send(t *testing.T) {
+	var rsvData []byte
+	var states []bool
+
+	client := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_COMPRESS2, Him: TELNET_DO}}, nil, nil)
+	client.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		switch telnetEvent.EventType() {
+		case TELNET_EV_DATA:
+			rsvData = append(rsvData, telnetEvent.(*TelnetDataEvent).Buffer...)
+		case TELNET_EV_COMPRESS:
+			states = append(states, telnetEvent.(*TelnetCompressEvent).State)
+		}
+	}
+	client.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_COMPRESS2})
+	server := NewTelnet(nil, nil, nil)
+	server.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_SEND {
+			client.TelnetRecv(telnetEvent.(*TelnetSendEvent).Buffer)
+		}
+	}
+
+	server.TelnetBeginCompress2()
+	server.TelnetSend([]byte("room text "))
+	server.TelnetSend([]byte{TELNET_IAC})
+	server.TelnetEndCompress2()
+	server.TelnetSend([]byte(" plain"))
+	client.TelnetClose()
+
+	if string(rsvData) != "room text \xff plain" {
+		t.Errorf("Received data %q not equal with expected", rsvData)
+	}
+	if len(states) != 2 || !states[0] || states[1] {
+		t.Errorf("Unexpected compression events %v", states)
+	}
+}
+
+func TestCompressNotNegotiated(t *testing.T) {
+	for _, telopt := range []byte{TELOPT_COMPRESS2, TELOPT_MCCP3} {
+		var rsvData []byte
+		var warnings []TelnetErrorCode
+		telnet := NewTelnet(nil, nil, nil)
+		telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+			switch ev := telnetEvent.(type) {
+			case *TelnetDataEvent:
+				rsvData = append(rsvData, ev.Buffer...)
+			case *TelnetErrorEvent:
+				if ev.Fatal {
+					t.Errorf("Unexpected error %v", ev.Message)
+				}
+				warnings = append(warnings, ev.Code)
+			}
+		}
+
+		telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), telopt, TELNET_IAC, byte(TELNET_SE), 'h', 'i'})
+		if telnet.inflater != nil {
+			t.Errorf("Telopt %d compression was started without negotiation", telopt)
+			telnet.TelnetClose()
+		}
+		if string(rsvData) != "hi" {
+			t.Errorf("Data after telopt %d marker was lost: %q", telopt, rsvData)
+		}
+		if len(warnings) != 1 || warnings[0] != TELNET_EPROTOCOL {
+			t.Errorf("Unexpected warnings %v", warnings)
+		}
+	}
+}
+
+func TestCompress2Ratio(t *testing.T) {
+	var text bytes.Buffer
+	for i := 0; text.Len() < 16800; i++ {
+		fmt.Fprintf(&text, "You are standing in room %d of a long corridor.\nExits: north, south.\n", i%10)
+	}
+
+	server := NewTelnet(nil, nil, nil)
+	var sent [][]byte
+	server.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_SEND {
+			sent = append(sent, append([]byte(nil), telnetEvent.(*TelnetSendEvent).Buffer...))
+		}
+	}
+	server.TelnetBeginCompress2()
+	sent = nil
+	server.TelnetSendText(text.Bytes())
+
+	// whole call is compressed as one chunk
+	if len(sent) != 1 {
+		t.Errorf("Text was sent in %d chunks", len(sent))
+	}
+	compressed := bytes.Join(sent, nil)
+	if len(compressed) > text.Len()/10 {
+		t.Errorf("Poor compression: %d bytes of text compressed to %d", text.Len(), len(compressed))
+	}
+
+	// the chunk is flushed, so it can be inflated right away
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.ReplaceAll(text.String(), "\n", "\r\n")
+	inflated := make([]byte, len(expected))
+	if _, err := io.ReadFull(zr, inflated); err != nil || string(inflated) != expected {
+		t.Errorf("Inflated text not equal with expected: %v", err)
+	}
+}
+
+// Connect two telnet state trackers back to back. Sent data is queued
+// so that neither tracker is re-entered while processing.
+func connectTelnets(a, b *Telnet, onA, onB func(TelnetEventInterface)) {
+	var queue []func()
+	var busy bool
+	deliver := func(to *Telnet, buffer []byte) {
+		buffer = append([]byte(nil), buffer...)
+		queue = append(queue, func() { to.TelnetRecv(buffer) })
+		if busy {
+			return
+		}
+		busy = true
+		for len(queue) != 0 {
+			f := queue[0]
+			queue = queue[1:]
+			f()
+		}
+		busy = false
+	}
+
+	a.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_SEND {
+			deliver(b, telnetEvent.(*TelnetSendEvent).Buffer)
+		} else if onA != nil {
+			onA(telnetEvent)
+		}
+	}
+	b.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_SEND {
+			deliver(a, telnetEvent.(*TelnetSendEvent).Buffer)
+		} else if onB != nil {
+			onB(telnetEvent)
+		}
+	}
+}
+
+func TestMCCP3(t *testing.T) {
+	var rsvData []byte
+	var compressEvents []*TelnetCompressEvent
+
+	server := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_MCCP3, Us: TELNET_WILL, Him: TELNET_DONT}}, nil, nil)
+	client := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_MCCP3, Us: TELNET_WONT, Him: TELNET_DO}}, nil, nil)
+	connectTelnets(server, client, func(telnetEvent TelnetEventInterface) {
+		switch telnetEvent.EventType() {
+		case TELNET_EV_DATA:
+			rsvData = append(rsvData, telnetEvent.(*TelnetDataEvent).Buffer...)
+		case TELNET_EV_COMPRESS:
+			compressEvents = append(compressEvents, telnetEvent.(*TelnetCompressEvent))
+		}
+	}, nil)
+
+	// not agreed yet
+	client.TelnetBeginCompress3()
+	server.TelnetNegotiate(TELNET_WILL, TELOPT_MCCP3)
+	client.TelnetBeginCompress3()
+	client.TelnetSend([]byte("look"))
+	client.TelnetEndCompress3()
+	client.TelnetSend([]byte(" around"))
+	server.TelnetClose()
+
+	if string(rsvData) != "look around" {
+		t.Errorf("Received data %q not equal with expected", rsvData)
+	}
+	if len(compressEvents) != 2 || compressEvents[0].TelOpt != TELOPT_MCCP3 || compressEvents[0].Outbound || !compressEvents[0].State {
+		t.Errorf("Unexpected compression events %v", compressEvents)
+	}
+}
+
+func TestZmp(t *testing.T) {
+	var argv [][]string
+	var warnings []*TelnetErrorEvent
+
+	sender := NewTelnet(nil, nil, nil)
+	receiver := NewTelnet(nil, nil, nil)
+	connectTelnets(sender, receiver, nil, func(telnetEvent TelnetEventInterface) {
+		switch telnetEvent.EventType() {
+		case TELNET_EV_ZMP:
+			argv = append(argv, telnetEvent.(*TelnetZmpEvent).Argv)
+		case TELNET_EV_WARNING:
+			warnings = append(warnings, telnetEvent.(*TelnetErrorEvent))
+		}
+	})
+
+	sender.TelnetSendZmp("zmp.check", "", "color.\xff")
+	sender.TelnetSubnegotiation(TELOPT_ZMP, []byte("zmp.ping"))
+	sender.TelnetSubnegotiation(TELOPT_ZMP, []byte{0, 'x', 0})
+
+	if len(argv) != 1 || len(argv[0]) != 3 || argv[0][0] != "zmp.check" || argv[0][1] != "" || argv[0][2] != "color.\xff" {
+		t.Errorf("Unexpected ZMP commands %q", argv)
+	}
+	if len(warnings) != 2 || warnings[0].Code != TELNET_EPROTOCOL || warnings[0].Fatal {
+		t.Errorf("Unexpected warnings %v", warnings)
+	}
+}
+
+func TestTType(t *testing.T) {
+	var names []string
+
+	server := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_TTYPE, Him: TELNET_DO}}, nil, nil)
+	client := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_TTYPE, Us: TELNET_WILL}}, nil, nil)
+	client.TerminalTypes = []string{"xterm-256color", "ansi"}
+
+	// SEND is not answered before TTYPE is agreed
+	sent := collectSend(client)
+	client.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_TTYPE, byte(TELNET_TTYPE_SEND), TELNET_IAC, byte(TELNET_SE)})
+	if len(*sent) != 0 {
+		t.Errorf("Unsolicited TTYPE SEND was answered: %v", *sent)
+	}
+
+	connectTelnets(server, client, func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_TTYPE {
+			ttypeEvent := telnetEvent.(*TelnetTTypeEvent)
+			if ttypeEvent.Cmd != TELNET_TTYPE_IS {
+				t.Errorf("Unexpected TTYPE command %d", ttypeEvent.Cmd)
+			}
+			names = append(names, ttypeEvent.Name)
+		}
+	}, nil)
+	server.TelnetNegotiate(TELNET_DO, TELOPT_TTYPE)
+
+	for i := 0; i < 4; i++ {
+		server.TelnetTTypeSend()
+	}
+
+	expected := []string{"xterm-256color", "ansi", "ansi", "xterm-256color"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Terminal types %v not equal with expected %v", names, expected)
+	}
+}
+
+func TestEnvironRecv(t *testing.T) {
+	var environEvents []*TelnetEnvironEvent
+
+	telnet := NewTelnet(nil, nil, nil)
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_ENVIRON {
+			environEvents = append(environEvents, telnetEvent.(*TelnetEnvironEvent))
+		}
+	}
+
+	// NEW-ENVIRON IS VAR "USER" VALUE "bob" USERVAR "A\x01B" VALUE "" VAR "LANG"
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_NEW_ENVIRON, 0,
+		0, 'U', 'S', 'E', 'R', 1, 'b', 'o', 'b',
+		3, 'A', 2, 1, 'B', 1,
+		0, 'L', 'A', 'N', 'G',
+		TELNET_IAC, byte(TELNET_SE)})
+	// OLD-ENVIRON IS with swapped codes: VAR=1, VALUE=0
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_OLD_ENVIRON, 0,
+		1, 'L', 'A', 'N', 'G', 0, 'e', 'n',
+		TELNET_IAC, byte(TELNET_SE)})
+
+	if len(environEvents) != 2 {
+		t.Fatalf("Expected 2 environ events, got %d", len(environEvents))
+	}
+	expected := []TelnetEnvironValue{
+		{Type: TELNET_ENVIRON_VAR, Name: "USER", Value: "bob"},
+		{Type: TELNET_ENVIRON_USERVAR, Name: "A\x01B"},
+		{Type: TELNET_ENVIRON_VAR, Name: "LANG", Undefined: true},
+	}
+	values := environEvents[0].Values
+	if environEvents[0].Cmd != TELNET_ENVIRON_IS || len(values) != len(expected) {
+		t.Fatalf("Unexpected environ event %v", environEvents[0])
+	}
+	for i := range expected {
+		if values[i] != expected[i] {
+			t.Errorf("Variable %v not equal with expected %v", values[i], expected[i])
+		}
+	}
+	values = environEvents[1].Values
+	if len(values) != 1 || values[0] != (TelnetEnvironValue{Type: TELNET_ENVIRON_VAR, Name: "LANG", Value: "en"}) {
+		t.Errorf("Unexpected OLD-ENVIRON variables %v", values)
+	}
+}
+
+func TestEnvironSend(t *testing.T) {
+	var environEvents []*TelnetEnvironEvent
+
+	client := NewTelnet(nil, nil, nil)
+	server := NewTelnet(nil, nil, nil)
+	connectTelnets(client, server, nil, func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_ENVIRON {
+			environEvents = append(environEvents, telnetEvent.(*TelnetEnvironEvent))
+		}
+	})
+
+	sent := []TelnetEnvironValue{
+		{Type: TELNET_ENVIRON_VAR, Name: "USER", Value: "root"},
+		{Type: TELNET_ENVIRON_VAR, Name: "TERM", Value: "xterm"},
+		{Type: TELNET_ENVIRON_USERVAR, Name: "\x00\x01\x02\x03", Value: "a\x01b\xff"},
+		{Type: TELNET_ENVIRON_VAR, Name: "DISPLAY"},
+		{Type: TELNET_ENVIRON_VAR, Name: "PRINTER", Undefined: true},
+	}
+	server.TelnetSendEnviron(TELNET_ENVIRON_SEND, sent[:2])
+	client.TelnetSendEnviron(TELNET_ENVIRON_IS, sent)
+
+	if len(environEvents) != 1 || environEvents[0].Cmd != TELNET_ENVIRON_IS || len(environEvents[0].Values) != len(sent) {
+		t.Fatalf("Unexpected environ events %v", environEvents)
+	}
+	for i := range sent {
+		if environEvents[0].Values[i] != sent[i] {
+			t.Errorf("Variable %v not equal with expected %v", environEvents[0].Values[i], sent[i])
+		}
+	}
+}
+
+func TestMsspRecv(t *testing.T) {
+	var pairs []MSSPPair
+
+	telnet := NewTelnet(nil, nil, nil)
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_MSSP {
+			pairs = telnetEvent.(*TelnetMsspEvent).Values
+		}
+	}
+
+	stream := []byte{TELNET_IAC, byte(TELNET_SB), TELOPT_MSSP}
+	stream = append(stream, "\x01NAME\x02Test MUD\x01PORT\x024000\x025000\x01EMPTY\x02"...)
+	stream = append(stream, TELNET_IAC, byte(TELNET_SE))
+	telnet.TelnetRecv(stream)
+
+	expected := []MSSPPair{
+		{Name: "NAME", Values: []string{"Test MUD"}},
+		{Name: "PORT", Values: []string{"4000", "5000"}},
+		{Name: "EMPTY", Values: []string{""}},
+	}
+	if len(pairs) != len(expected) {
+		t.Fatalf("Unexpected MSSP variables %q", pairs)
+	}
+	for i := range expected {
+		if pairs[i].Name != expected[i].Name || strings.Join(pairs[i].Values, ",") != strings.Join(expected[i].Values, ",") {
+			t.Errorf("Variable %q not equal with expected %q", pairs[i], expected[i])
+		}
+	}
+}
+
+func TestMsspSend(t *testing.T) {
+	var pairs []MSSPPair
+
+	server := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_MSSP, Us: TELNET_WILL, Him: TELNET_DONT}}, nil, nil)
+	server.MSSP = map[string][]string{
+		"PORT":    {"4000", "5000"},
+		"NAME":    {"Test MUD"},
+		"PLAYERS": {"\xff"},
+	}
+	crawler := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_MSSP, Us: TELNET_WONT, Him: TELNET_DO}}, nil, nil)
+	connectTelnets(server, crawler, nil, func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_MSSP {
+			pairs = telnetEvent.(*TelnetMsspEvent).Values
+		}
+	})
+
+	server.TelnetNegotiate(TELNET_WILL, TELOPT_MSSP)
+
+	if len(pairs) != 3 {
+		t.Fatalf("Unexpected MSSP variables %q", pairs)
+	}
+	if pairs[0].Name != "NAME" || pairs[1].Name != "PLAYERS" || pairs[2].Name != "PORT" {
+		t.Errorf("Variables %q are not sorted", pairs)
+	}
+	if pairs[1].Values[0] != "\xff" || strings.Join(pairs[2].Values, ",") != "4000,5000" {
+		t.Errorf("Unexpected MSSP values %q", pairs)
+	}
+}
+
+func TestErrorEvents(t *testing.T) {
+	var errorEvents []*TelnetErrorEvent
+
+	telnet := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WONT, Him: TELNET_DO}}, nil, nil)
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		switch telnetEvent.EventType() {
+		case TELNET_EV_WARNING, TELNET_EV_ERROR:
+			errorEvents = append(errorEvents, telnetEvent.(*TelnetErrorEvent))
+		}
+	}
+
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_ECHO})
+	telnet.TelnetNegotiate(TELNET_DONT, TELOPT_ECHO)
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_ECHO})
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_SGA, 'x', TELNET_IAC, byte(TELNET_NOP)})
+
+	if len(errorEvents) != 2 {
+		t.Fatalf("Expected 2 warnings, got %d", len(errorEvents))
+	}
+	for _, ev := range errorEvents {
+		if ev.EventType() != TELNET_EV_WARNING || ev.Fatal || ev.Code != TELNET_EPROTOCOL {
+			t.Errorf("Unexpected warning %v", ev)
+		}
+	}
+	if errorEvents[0].Message != "DONT answered by WILL" {
+		t.Errorf("Unexpected warning message %q", errorEvents[0].Message)
+	}
+
+	var err error = TELNET_ECOMPRESS
+	if err.Error() != "error handling compressed streams" {
+		t.Errorf("Unexpected error text %q", err.Error())
+	}
+}
+
+func TestSubnegotiationOverflow(t *testing.T) {
+	var errorEvents []*TelnetErrorEvent
+	var subnegotiations int
+	var rsvData []byte
+
+	telnet := NewTelnet(nil, nil, nil)
+	telnet.MaxSubnegotiation = 4
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		switch telnetEvent.EventType() {
+		case TELNET_EV_WARNING:
+			errorEvents = append(errorEvents, telnetEvent.(*TelnetErrorEvent))
+		case TELNET_EV_SUBNEGOTIATION:
+			subnegotiations++
+		case TELNET_EV_DATA:
+			rsvData = append(rsvData, telnetEvent.(*TelnetDataEvent).Buffer...)
+		}
+	}
+
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_TTYPE, 1, 2, 3, 4, 'a', 'b'})
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_TTYPE, 1, TELNET_IAC, TELNET_IAC, 3, TELNET_IAC, byte(TELNET_SE)})
+
+	if len(errorEvents) != 1 || errorEvents[0].Code != TELNET_EOVERFLOW {
+		t.Fatalf("Unexpected warnings %v", errorEvents)
+	}
+	if string(rsvData) != "b" {
+		t.Errorf("Data after overflow %q not equal with expected", rsvData)
+	}
+	if subnegotiations != 1 {
+		t.Errorf("Subnegotiation within the limit was not processed")
+	}
+}
+
+func TestOptionState(t *testing.T) {
+	server := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WILL, Him: TELNET_DONT}}, nil, nil)
+	client := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WONT, Him: TELNET_DO}}, nil, nil)
+
+	// offer is not answered yet
+	server.TelnetNegotiate(TELNET_WILL, TELOPT_ECHO)
+	if state := server.OptionState(TELOPT_ECHO); state.Us() != Q_WANTYES || state.Him() != Q_NO {
+		t.Errorf("Unexpected pending ECHO state %v/%v", state.Us(), state.Him())
+	}
+	client.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_ECHO})
+	server.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_DO), TELOPT_ECHO})
+
+	connectTelnets(server, client, nil, nil)
+	server.TelnetNegotiate(TELNET_WILL, TELOPT_SGA)
+
+	if !server.LocalEnabled(TELOPT_ECHO) || server.RemoteEnabled(TELOPT_ECHO) {
+		t.Errorf("Unexpected server ECHO state %v", server.OptionState(TELOPT_ECHO))
+	}
+	if !client.RemoteEnabled(TELOPT_ECHO) || client.LocalEnabled(TELOPT_ECHO) {
+		t.Errorf("Unexpected client ECHO state %v", client.OptionState(TELOPT_ECHO))
+	}
+	if state := server.OptionState(TELOPT_SGA); state.Us() != Q_NO || state.TelOpt() != TELOPT_SGA {
+		t.Errorf("Refused option state %v/%v", state.Us(), state.Him())
+	}
+	if states := server.OptionStates(); len(states) != 1 || states[0].TelOpt() != TELOPT_ECHO {
+		t.Errorf("Unexpected option states %v", states)
+	}
+}
+
+type testOptionHandler struct {
+	BaseOptionHandler
+	calls []string
+}
+
+func (h *testOptionHandler) AcceptRemote(tl *Telnet) bool {
+	return true
+}
+
+func (h *testOptionHandler) OnRemoteEnable(tl *Telnet) {
+	h.calls = append(h.calls, "enable")
+}
+
+func (h *testOptionHandler) OnDisable(tl *Telnet, local bool) {
+	h.calls = append(h.calls, fmt.Sprintf("disable:%v", local))
+}
+
+func (h *testOptionHandler) OnSubnegotiation(tl *Telnet, buffer []byte) {
+	h.calls = append(h.calls, fmt.Sprintf("sb:%v", buffer))
+}
+
+func TestOptionHandler(t *testing.T) {
+	handler := &testOptionHandler{}
+	server := NewTelnet(nil, nil, nil)
+	server.RegisterOption(TELOPT_NAWS, handler)
+	client := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_NAWS, Us: TELNET_WILL, Him: TELNET_DONT}}, nil, nil)
+	connectTelnets(server, client, nil, nil)
+
+	server.TelnetNegotiate(TELNET_DO, TELOPT_NAWS)
+	client.TelnetSubnegotiation(TELOPT_NAWS, []byte{0, 80, 0, 24})
+	client.TelnetNegotiate(TELNET_WONT, TELOPT_NAWS)
+
+	expected := "enable,sb:[0 80 0 24],disable:false"
+	if strings.Join(handler.calls, ",") != expected {
+		t.Errorf("Handler calls %v not equal with expected %s", handler.calls, expected)
+	}
+	if server.RemoteEnabled(TELOPT_NAWS) {
+		t.Errorf("NAWS is still enabled on the peer side")
+	}
+
+	// handler refuses local side
+	server.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_DO), TELOPT_NAWS})
+	if server.LocalEnabled(TELOPT_NAWS) {
+		t.Errorf("Option refused by handler was enabled")
+	}
+}
+
+func TestBinaryFlags(t *testing.T) {
+	telnet := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_BINARY, Us: TELNET_WILL, Him: TELNET_DO}}, []TelnetFlags{TELNET_FLAG_NVT_EOL}, nil)
+	sent := collectSend(telnet)
+
+	// binary mode enabled by the first negotiation of the option
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_DO), byte(TELOPT_BINARY)})
+	*sent = nil
+	telnet.TelnetSendText([]byte("a\n"))
+	if len(*sent) != 1 || string((*sent)[0]) != "a\n" {
+		t.Errorf("Text was translated in binary mode: %q", *sent)
+	}
+
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_DONT), byte(TELOPT_BINARY)})
+	*sent = nil
+	telnet.TelnetSendText([]byte("a\n"))
+	if len(*sent) != 2 || string((*sent)[1]) != "\r\n" {
+		t.Errorf("Text was not translated in NVT mode: %q", *sent)
+	}
+}
+
+// Stream of option negotiations over the whole option range
+func negotiationStream() []byte {
+	var stream []byte
+	for i := 0; i < 256; i++ {
+		if i == TELNET_IAC {
+			continue
+		}
+		stream = append(stream, TELNET_IAC, byte(TELNET_WILL), byte(i), TELNET_IAC, byte(TELNET_DO), byte(i))
+		stream = append(stream, TELNET_IAC, byte(TELNET_WONT), byte(i), TELNET_IAC, byte(TELNET_DONT), byte(i))
+	}
+	return stream
+}
+
+func BenchmarkNegotiate(b *testing.B) {
+	var options []TelnetOptionReq
+	for i := 0; i < 256; i += 2 {
+		options = append(options, TelnetOptionReq{TelOpt: TelnetOptions(i), Us: TELNET_WILL, Him: TELNET_DO})
+	}
+	telnet := NewTelnet(options, nil, nil)
+	stream := negotiationStream()
+
+	b.SetBytes(int64(len(stream)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		telnet.TelnetRecv(stream)
+	}
+}
+
+func BenchmarkOptionState(b *testing.B) {
+	telnet := NewTelnet(nil, nil, nil)
+	for i := 0; i < 256; i++ {
+		telnet.setRFC1143(byte(i), byte(Q_YES), byte(Q_NO))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		telnet.LocalEnabled(byte(i))
+	}
+}
+
+func TestDataRuns(t *testing.T) {
+	var events []string
+	telnet := NewTelnet(nil, []TelnetFlags{TELNET_FLAG_NVT_EOL}, nil)
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_DATA {
+			events = append(events, string(telnetEvent.(*TelnetDataEvent).Buffer))
+		}
+	}
+
+	telnet.TelnetRecv([]byte("abc\r\ndef\r\x00gh"))
+	telnet.TelnetRecv([]byte{'i', TELNET_IAC, TELNET_IAC, 'j', TELNET_IAC, byte(TELNET_NOP), 'k', '\r'})
+	telnet.TelnetRecv([]byte("x"))
+
+	expected := []string{"abc", "\ndef", "\r", "gh", "i", "\xff", "j", "k", "\r", "x"}
+	if fmt.Sprintf("%q", events) != fmt.Sprintf("%q", expected) {
+		t.Errorf("Unexpected data events %q", events)
+	}
+}
+
+// Binary payload of the given size with IAC bytes escaped
+func binaryStream(size int) []byte {
+	stream := make([]byte, 0, size+size/128)
+	for i := 0; len(stream) < size; i++ {
+		b := byte(i * 7)
+		if b == TELNET_IAC {
+			stream = append(stream, TELNET_IAC)
+		}
+		stream = append(stream, b)
+	}
+	return stream
+}
+
+func benchmarkRecv(b *testing.B, telnet *Telnet, stream []byte) {
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {}
+
+	b.SetBytes(int64(len(stream)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		telnet.TelnetRecv(stream)
+	}
+}
+
+func BenchmarkRecvBinary(b *testing.B) {
+	benchmarkRecv(b, NewTelnet(nil, nil, nil), binaryStream(1<<20))
+}
+
+func BenchmarkRecvPlain(b *testing.B) {
+	benchmarkRecv(b, NewTelnet(nil, nil, nil), bytes.Repeat([]byte("0123456789abcdef"), 1<<16))
+}
+
+func BenchmarkRecvText(b *testing.B) {
+	benchmarkRecv(b, NewTelnet(nil, []TelnetFlags{TELNET_FLAG_NVT_EOL}, nil), bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog\r\n"), 1<<14))
+}
+
+func TestReuseEventsAllocs(t *testing.T) {
+	telnet := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_ECHO, Us: TELNET_WILL}}, []TelnetFlags{TELNET_FLAG_NVT_EOL}, nil)
+	telnet.ReuseEvents = true
+	var received, sent int
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		switch ev := telnetEvent.(type) {
+		case *TelnetDataEvent:
+			received += len(ev.Buffer)
+		case *TelnetSendEvent:
+			sent += len(ev.Buffer)
+		}
+	}
+
+	input := []byte("abc\r\ndef\r\x00g\xff\xffh")
+	input = append(input, TELNET_IAC, byte(TELNET_NOP))
+	input = append(input, TELNET_IAC, byte(TELNET_DO), byte(TELOPT_ECHO))
+	input = append(input, TELNET_IAC, byte(TELNET_DONT), byte(TELOPT_ECHO))
+	output := []byte("text\xffwith\nnewlines\r")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		telnet.TelnetRecv(input)
+		telnet.TelnetSendText(output)
+		telnet.TelnetSend(output)
+		telnet.TelnetIAC(byte(TELNET_NOP))
+	})
+	if allocs != 0 {
+		t.Errorf("Unexpected %v allocations per run", allocs)
+	}
+	if received == 0 || sent == 0 {
+		t.Error("No events delivered")
+	}
+}
+
+func TestReuseEventsBuffers(t *testing.T) {
+	telnet := NewTelnet(nil, nil, nil)
+	telnet.ReuseEvents = true
+	var events []TelnetEventInterface
+	var data []string
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_DATA {
+			events = append(events, telnetEvent)
+			data = append(data, string(telnetEvent.(*TelnetDataEvent).Buffer))
+		}
+	}
+
+	telnet.TelnetRecv([]byte{'a', TELNET_IAC, TELNET_IAC, 'b'})
+	if len(events) != 3 || events[0] != events[2] {
+		t.Errorf("Data event was not reused: %v", events)
+	}
+	if fmt.Sprintf("%q", data) != `["a" "\xff" "b"]` {
+		t.Errorf("Unexpected data %q", data)
+	}
+}
+
+func TestIacCommands(t *testing.T) {
+	var cmds []TelnetCommands
+	telnet := NewTelnet(nil, nil, nil)
+	telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_IAC {
+			cmds = append(cmds, telnetEvent.(*TelnetIacEvent).Cmd)
+		}
+	}
+
+	expected := []TelnetCommands{TELNET_IP, TELNET_AO, TELNET_AYT, TELNET_EC, TELNET_EL, TELNET_BRK, TELNET_GA, TELNET_NOP, TELNET_EOR, TELNET_DM}
+	for _, cmd := range expected {
+		telnet.TelnetRecv([]byte{'x', TELNET_IAC, byte(cmd)})
+	}
+	if fmt.Sprint(cmds) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected commands %v", cmds)
+	}
+	if fmt.Sprint(cmds) != "[IP AO AYT EC EL BRK GA NOP EOR DM]" {
+		t.Errorf("Unexpected command names %v", cmds)
+	}
+	if TelnetCommands(1).String() != "TelnetCommands(1)" {
+		t.Errorf("Unexpected name of unknown command %v", TelnetCommands(1))
+	}
+}
+
+func TestAYTResponse(t *testing.T) {
+	telnet := NewTelnet(nil, []TelnetFlags{TELNET_FLAG_NVT_EOL}, nil)
+	sent := collectSend(telnet)
+
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_AYT)})
+	if len(*sent) != 0 {
+		t.Errorf("AYT answered with no response configured: %q", *sent)
+	}
+
+	telnet.AYTResponse = "[yes]\n"
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_AYT)})
+	if string(bytes.Join(*sent, nil)) != "[yes]\r\n" {
+		t.Errorf("Unexpected AYT response %q", *sent)
+	}
+}
+
+func TestTimingMark(t *testing.T) {
+	client := NewTelnet(nil, nil, nil)
+	server := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_TM, Us: TELNET_WILL}}, nil, nil)
+	var marks []*TelnetTimingMarkEvent
+	var serverData []string
+	connectTelnets(client, server, func(telnetEvent TelnetEventInterface) {
+		if te, ok := telnetEvent.(*TelnetTimingMarkEvent); ok {
+			marks = append(marks, te)
+		}
+	}, func(telnetEvent TelnetEventInterface) {
+		if de, ok := telnetEvent.(*TelnetDataEvent); ok {
+			serverData = append(serverData, string(de.Buffer))
+		}
+	})
+
+	client.TelnetSend([]byte("ls"))
+	client.TelnetTimingMark()
+	if len(marks) != 1 || !marks[0].Accepted || marks[0].RTT < 0 {
+		t.Fatalf("Unexpected timing marks %v", marks)
+	}
+	if len(serverData) != 1 || serverData[0] != "ls" {
+		t.Errorf("Data before the mark was not processed: %q", serverData)
+	}
+	if client.OptionState(TELOPT_TM).Him() != Q_NO || server.OptionState(TELOPT_TM).Us() != Q_NO {
+		t.Error("TIMING-MARK was tracked as a stateful option")
+	}
+
+	// peer without TIMING-MARK support refuses the mark
+	other := NewTelnet(nil, nil, nil)
+	connectTelnets(client, other, func(telnetEvent TelnetEventInterface) {
+		if te, ok := telnetEvent.(*TelnetTimingMarkEvent); ok {
+			marks = append(marks, te)
+		}
+	}, nil)
+	client.TelnetTimingMark()
+	if len(marks) != 2 || marks[1].Accepted {
+		t.Errorf("Unexpected timing marks %v", marks)
+	}
+
+	// unsolicited WILL is refused
+	sent := collectSend(client)
+	client.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_TM})
+	if len(*sent) != 1 || !bytes.Equal((*sent)[0], []byte{TELNET_IAC, byte(TELNET_DONT), TELOPT_TM}) {
+		t.Errorf("Unexpected reply to unsolicited WILL %v", *sent)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	server := NewTelnet([]TelnetOptionReq{
+		{TelOpt: TELOPT_ECHO, Us: TELNET_WILL},
+		{TelOpt: TELOPT_STATUS, Us: TELNET_WILL},
+		{TelOpt: TELOPT_NAWS, Him: TELNET_DO},
+		{TelOpt: 240, Us: TELNET_WILL},
+	}, nil, nil)
+	client := NewTelnet([]TelnetOptionReq{
+		{TelOpt: TELOPT_ECHO, Him: TELNET_DO},
+		{TelOpt: TELOPT_STATUS, Him: TELNET_DO},
+		{TelOpt: TELOPT_NAWS, Us: TELNET_WILL},
+		{TelOpt: 240, Him: TELNET_DO},
+	}, nil, nil)
+	var status []*TelnetStatusEvent
+	var serverSent [][]byte
+	connectTelnets(client, server, func(telnetEvent TelnetEventInterface) {
+		if se, ok := telnetEvent.(*TelnetStatusEvent); ok {
+			status = append(status, se)
+		}
+	}, nil)
+	onSend := server.OnTelnetEvent
+	server.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		if se, ok := telnetEvent.(*TelnetSendEvent); ok {
+			serverSent = append(serverSent, append([]byte(nil), se.Buffer...))
+		}
+		onSend(telnetEvent)
+	}
+
+	for _, telopt := range []byte{TELOPT_ECHO, TELOPT_STATUS, 240} {
+		server.TelnetNegotiate(TELNET_WILL, telopt)
+	}
+	server.TelnetNegotiate(TELNET_DO, TELOPT_NAWS)
+	serverSent = nil
+
+	client.TelnetStatusSend()
+	if len(status) != 1 || status[0].Cmd != TELNET_STATUS_IS {
+		t.Fatalf("Unexpected status events %v", status)
+	}
+	if fmt.Sprint(status[0].Will) != fmt.Sprint([]TelnetOptions{TELOPT_ECHO, TELOPT_STATUS, 240}) || fmt.Sprint(status[0].Do) != fmt.Sprint([]TelnetOptions{TELOPT_NAWS}) {
+		t.Errorf("Unexpected status %v/%v", status[0].Will, status[0].Do)
+	}
+	expected := []byte{TELNET_IAC, byte(TELNET_SB), TELOPT_STATUS, byte(TELNET_STATUS_IS),
+		byte(TELNET_WILL), TELOPT_ECHO, byte(TELNET_WILL), TELOPT_STATUS, byte(TELNET_DO), TELOPT_NAWS,
+		byte(TELNET_WILL), 240, 240, TELNET_IAC, byte(TELNET_SE)}
+	if len(serverSent) != 1 || !bytes.Equal(serverSent[0], expected) {
+		t.Errorf("Unexpected STATUS IS %v", serverSent)
+	}
+
+	// SEND is not answered by a peer not performing STATUS
+	client.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_STATUS, byte(TELNET_STATUS_SEND), TELNET_IAC, byte(TELNET_SE)})
+	if len(status) != 2 || status[1].Cmd != TELNET_STATUS_SEND {
+		t.Errorf("Unexpected status events %v", status)
+	}
+}
+
+func TestNaws(t *testing.T) {
+	client := NewTelnet(nil, nil, nil)
+	sent := collectSend(client)
+	client.TelnetSendNaws(255, 0x1ff)
+	expected := []byte{TELNET_IAC, byte(TELNET_SB), TELOPT_NAWS, 0, TELNET_IAC, TELNET_IAC, 1, TELNET_IAC, TELNET_IAC, TELNET_IAC, byte(TELNET_SE)}
+	if len(*sent) != 1 || !bytes.Equal((*sent)[0], expected) {
+		t.Errorf("Unexpected NAWS subnegotiation %v", *sent)
+	}
+
+	var sizes []*TelnetNawsEvent
+	var errors int
+	server := NewTelnet(nil, nil, nil)
+	server.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+		switch ev := telnetEvent.(type) {
+		case *TelnetNawsEvent:
+			sizes = append(sizes, ev)
+		case *TelnetErrorEvent:
+			errors++
+		}
+	}
+	server.TelnetRecv(expected)
+	if len(sizes) != 1 || sizes[0].Width != 255 || sizes[0].Height != 0x1ff {
+		t.Errorf("Unexpected window sizes %v", sizes)
+	}
+
+	server.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_NAWS, 0, 80, 0, TELNET_IAC, byte(TELNET_SE)})
+	if len(sizes) != 1 || errors != 1 {
+		t.Errorf("Short NAWS subnegotiation was accepted: %v", sizes)
+	}
+}
+
+func TestInflaterRelease(t *testing.T) {
+	options := []TelnetOptionReq{{TelOpt: TELOPT_COMPRESS2, Him: TELNET_DO}}
+	trackers := map[string]func() *Telnet{
+		"no handler": func() *Telnet {
+			return NewTelnet(options, nil, nil)
+		},
+		// handler and state tracker refer to each other
+		"handler": func() *Telnet {
+			telnet := NewTelnet(options, nil, nil)
+			telnet.OnTelnetEvent = func(telnetEvent TelnetEventInterface) {
+				telnet.userData = telnetEvent
+			}
+			return telnet
+		},
+		"Conn": func() *Telnet {
+			return NewConn(new(bytes.Buffer), options, nil).telnet
+		},
+	}
+
+	for name, newTracker := range trackers {
+		before := runtime.NumGoroutine()
+		func() {
+			telnet := newTracker()
+			telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_COMPRESS2})
+			telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_COMPRESS2, TELNET_IAC, byte(TELNET_SE)})
+			if telnet.inflater == nil {
+				t.Fatalf("%s: compression was not started", name)
+			}
+		}()
+
+		// abandoned state tracker releases the inflater goroutine
+		for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+			runtime.GC()
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := runtime.NumGoroutine(); n > before {
+			t.Errorf("%s: inflater goroutine leaked: %d goroutines, %d before", name, n, before)
+		}
+	}
+}
+
+func TestInflaterCloseTwice(t *testing.T) {
+	telnet := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_COMPRESS2, Him: TELNET_DO}}, nil, nil)
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_WILL), TELOPT_COMPRESS2})
+	telnet.TelnetRecv([]byte{TELNET_IAC, byte(TELNET_SB), TELOPT_COMPRESS2, TELNET_IAC, byte(TELNET_SE)})
+	z := telnet.inflater
+	telnet.TelnetClose()
+
+	// the finalizer of the stream runs after TelnetClose closed it
+	z.close()
+}
+
+func TestIacPredicates(t *testing.T) {
+	predicates := map[TelnetCommands]func(*TelnetIacEvent) bool{
+		TELNET_IP:  (*TelnetIacEvent).IsInterrupt,
+		TELNET_AO:  (*TelnetIacEvent).IsAbortOutput,
+		TELNET_AYT: (*TelnetIacEvent).IsAreYouThere,
+		TELNET_EC:  (*TelnetIacEvent).IsEraseCharacter,
+		TELNET_EL:  (*TelnetIacEvent).IsEraseLine,
+		TELNET_BRK: (*TelnetIacEvent).IsBreak,
+		TELNET_GA:  (*TelnetIacEvent).IsGoAhead,
+		TELNET_NOP: (*TelnetIacEvent).IsNoOperation,
+		TELNET_EOR: (*TelnetIacEvent).IsEndOfRecord,
+		TELNET_DM:  (*TelnetIacEvent).IsDataMark,
+	}
+	for cmd := range predicates {
+		ie := NewTelnetIacEvent()
+		ie.Cmd = cmd
+		for other, is := range predicates {
+			if is(ie) != (cmd == other) {
+				t.Errorf("Predicate of %v is %v for %v", other, is(ie), cmd)
+			}
+		}
+	}
+}
+
+func TestNegotiateTimingMarkRouted(t *testing.T) {
+	var marks int
+	client := NewTelnet(nil, nil, nil)
+	server := NewTelnet([]TelnetOptionReq{{TelOpt: TELOPT_TM, Us: TELNET_WILL}}, nil, nil)
+	connectTelnets(client, server, func(telnetEvent TelnetEventInterface) {
+		if telnetEvent.EventType() == TELNET_EV_TIMING_MARK {
+			marks++
+		}
+	}, nil)
+
+	client.TelnetNegotiate(TELNET_DO, TELOPT_TM)
+	server.TelnetNegotiate(TELNET_WILL, TELOPT_TM)
+	if marks != 1 {
+		t.Errorf("Expected 1 timing mark, got %d", marks)
+	}
+	if client.negotiating() || server.negotiating() {
+		t.Error("TIMING-MARK was left in a transitional state")
+	}
+}
@@ -0,0 +1,46 @@
+package pactelnet
+
+import "time"
+
+// Send DO TIMING-MARK (RFC 860). The peer answers once it has processed
+// everything sent before, which is reported with a TIMING_MARK event
+// carrying the round-trip time. Several marks may be outstanding; they
+// are answered in order.
+func (tl *Telnet) TelnetTimingMark() {
+	tl.timingMarks = append(tl.timingMarks, time.Now())
+	tl.sendNegotiate(TELNET_DO, byte(TELOPT_TM))
+}
+
+//------------------------------------------------------------------------------------------------//
+
+// Handle TIMING-MARK negotiation bypassing RFC1143 state: the option
+// is never enabled, it only marks a position in the data stream
+func (tl *Telnet) timingMark() {
+	switch tl.state {
+	case TELNET_STATE_WILL, TELNET_STATE_WONT:
+		if len(tl.timingMarks) == 0 {
+			// the mark was not requested, refuse it
+			if tl.state == TELNET_STATE_WILL {
+				tl.sendNegotiate(TELNET_DONT, byte(TELOPT_TM))
+			}
+			return
+		}
+		sent := tl.timingMarks[0]
+		tl.timingMarks = tl.timingMarks[1:]
+
+		te := NewTelnetTimingMarkEvent()
+		te.Accepted = tl.state == TELNET_STATE_WILL
+		te.RTT = time.Since(sent)
+		tl.callEventHandler(te)
+
+	case TELNET_STATE_DO:
+		// everything received before was processed, so the app may
+		// produce pending output before the reply
+		tl.negotiateEvent(TELNET_EV_DO, byte(TELOPT_TM))
+		if tl.checkTelOpt(byte(TELOPT_TM), true) {
+			tl.sendNegotiate(TELNET_WILL, byte(TELOPT_TM))
+		} else {
+			tl.sendNegotiate(TELNET_WONT, byte(TELOPT_TM))
+		}
+	}
+}